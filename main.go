@@ -54,6 +54,9 @@ func main() {
 	port := os.Getenv("PORT")
 	mainRouter := mux.NewRouter()
 
+	// Every request and its errors are logged with its ID
+	mainRouter.Use(middlewares.RequestIDHandler)
+
 	// Middleware for handling errors
 	mainRouter.Use(middlewares.ErrorHandler)
 	mainRouter.Use(middlewares.GormErrorHandler)
@@ -71,9 +74,10 @@ func main() {
 
 	// Correct CORS setup
 	corsObj := handlers.CORS(
-		handlers.AllowedOrigins([]string{"http://localhost:8081"}), // be specific if possible
-		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Authorization", "Content-Type"}),
+		handlers.AllowedOrigins(utils.AllowedOrigins), // be specific if possible
+		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "PATCH", "HEAD", "DELETE", "OPTIONS"}),
+		handlers.AllowedHeaders([]string{"Authorization", "Content-Type", "Upload-Offset", "X-API-Key", "Last-Event-ID", middlewares.RequestIDHeader}),
+		handlers.ExposedHeaders([]string{"Location", "Upload-Offset", "Upload-Length", middlewares.RequestIDHeader}), // resumable uploads
 	)
 
 	Logger.Info(fmt.Sprintf("🚀 Server running on 0.0.0.0:%s", port))
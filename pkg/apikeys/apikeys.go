@@ -0,0 +1,151 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	"github.com/Gamequic/LivePreviewBackend/utils"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var Logger *zap.Logger
+
+/*
+	API keys are the credentials of the integrations (hospital systems), they are sent on the X-API-Key header.
+	Format: ak_{prefix}_{secret}, only the prefix and the sha256 of the whole key are stored.
+	A key acts as its owner but only with the profiles of its scopes, scopes are profile names.
+*/
+
+const (
+	Header       = "X-API-Key"
+	keyTag       = "ak"
+	prefixLength = 8 // bytes, shown as hex
+	secretLength = 32
+)
+
+// last_used_at is written at most once per this interval
+const lastUsedInterval = time.Minute
+
+var (
+	ErrInvalidKey = errors.New("api key invalid")
+	ErrExpiredKey = errors.New("api key expired")
+)
+
+type ApiKeys struct {
+	gorm.Model
+	Name       string     `gorm:"not null"`
+	Prefix     string     `gorm:"uniqueIndex;not null"`
+	KeyHash    string     `gorm:"not null"`
+	Scopes     string     `gorm:"not null"` // profile names separated by commas
+	UserID     uint       `gorm:"index;not null"`
+	ExpiresAt  *time.Time // nil never expires
+	LastUsedAt *time.Time
+	LastUsedIP string
+
+	// Filled by Validate from the users table
+	OwnerEmail string `gorm:"->;-:migration"`
+	OwnerName  string `gorm:"->;-:migration"`
+}
+
+// Initialize the API keys
+func InitApiKeys() {
+	Logger = utils.NewLogger()
+	err := database.DB.AutoMigrate(&ApiKeys{})
+	if err != nil {
+		Logger.Error(fmt.Sprint("Failed to migrate database:", err))
+	}
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(length int) string {
+	bytes := make([]byte, length)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// Generate returns a new key and the values to store, the key can not be recovered later
+func Generate() (key string, prefix string, keyHash string) {
+	prefix = randomHex(prefixLength)
+	key = fmt.Sprintf("%s_%s_%s", keyTag, prefix, randomHex(secretLength))
+	return key, prefix, hashKey(key)
+}
+
+func (k *ApiKeys) ScopeList() []string {
+	if k.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(k.Scopes, ",")
+}
+
+// Profiles are the ids of the scopes that the owner still has, removing a profile from
+// the owner removes it from their keys too
+func (k *ApiKeys) Profiles() []string {
+	var profileIds []uint
+	database.DB.Raw(`
+		SELECT profiles.id
+		FROM profiles
+		JOIN user_profiles ON user_profiles.profile_id = profiles.id
+		WHERE user_profiles.user_id = ? AND profiles.name IN ?
+	`, k.UserID, k.ScopeList()).Scan(&profileIds)
+
+	profiles := make([]string, len(profileIds))
+	for i, id := range profileIds {
+		profiles[i] = strconv.Itoa(int(id))
+	}
+	return profiles
+}
+
+// Validate finds the key and checks it, the owner has to exist and be active
+func Validate(key string, ip string) (*ApiKeys, error) {
+	parts := strings.Split(key, "_")
+	if len(parts) != 3 || parts[0] != keyTag {
+		return nil, ErrInvalidKey
+	}
+
+	var apiKey ApiKeys
+	err := database.DB.
+		Select("api_keys.*, users.email AS owner_email, users.name AS owner_name").
+		Joins("JOIN users ON users.id = api_keys.user_id AND users.deleted_at IS NULL AND users.deactivated_at IS NULL").
+		Where("api_keys.prefix = ?", parts[1]).
+		First(&apiKey).Error
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			Logger.Error("Error getting api key", zap.Error(err))
+		}
+		return nil, ErrInvalidKey
+	}
+
+	if subtle.ConstantTimeCompare([]byte(apiKey.KeyHash), []byte(hashKey(key))) != 1 {
+		return nil, ErrInvalidKey
+	}
+
+	now := time.Now()
+	if apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(now) {
+		return nil, ErrExpiredKey
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > lastUsedInterval {
+		database.DB.Model(&apiKey).UpdateColumns(map[string]interface{}{
+			"last_used_at": now,
+			"last_used_ip": ip,
+		})
+	}
+
+	return &apiKey, nil
+}
@@ -0,0 +1,80 @@
+package events
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/utils"
+
+	"go.uber.org/zap"
+)
+
+var Logger *zap.Logger
+
+/*
+	In process event bus. The services publish what happened to their records and whoever
+	cares subscribes, so the publisher does not know what is done with the event.
+	The handlers run in background, a slow or failing handler never affects the request.
+*/
+
+// Event is something that happened, Data carries the values shown to the users
+type Event struct {
+	Type       string                 `json:"type"`
+	OccurredAt time.Time              `json:"occurred_at"`
+	ActorID    int                    `json:"actor_id"` // user that caused it, 0 for the system
+	HospitalID uint                   `json:"hospital_id"`
+	DoctorID   uint                   `json:"doctor_id"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+type Handler func(Event)
+
+// Initialize the event bus, before the services subscribe
+func InitEvents() {
+	Logger = utils.NewLogger()
+}
+
+var (
+	mu       sync.RWMutex
+	handlers = map[string][]Handler{}
+	wildcard []Handler
+)
+
+// Subscribe runs the handler on every event of the type
+func Subscribe(eventType string, handler Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	handlers[eventType] = append(handlers[eventType], handler)
+}
+
+// SubscribeAll runs the handler on every event
+func SubscribeAll(handler Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	wildcard = append(wildcard, handler)
+}
+
+// Publish hands the event to the subscribers in background
+func Publish(event Event) {
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now()
+	}
+
+	mu.RLock()
+	subscribers := append(append([]Handler{}, handlers[event.Type]...), wildcard...)
+	mu.RUnlock()
+
+	for _, handler := range subscribers {
+		go run(handler, event)
+	}
+}
+
+func run(handler Handler, event Event) {
+	defer func() {
+		if err := recover(); err != nil {
+			Logger.Error(fmt.Sprintf("Handler of event %s failed", event.Type), zap.Any("error", err))
+		}
+	}()
+	handler(event)
+}
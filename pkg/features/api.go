@@ -1,6 +1,8 @@
 package featuresApi
 
 import (
+	"github.com/Gamequic/LivePreviewBackend/pkg/apikeys"
+	"github.com/Gamequic/LivePreviewBackend/pkg/events"
 	"github.com/Gamequic/LivePreviewBackend/pkg/features/auth"
 	authservice "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/service"
 	"github.com/Gamequic/LivePreviewBackend/pkg/features/doctor"
@@ -19,15 +21,27 @@ import (
 	"github.com/Gamequic/LivePreviewBackend/pkg/features/system"
 	"github.com/Gamequic/LivePreviewBackend/pkg/features/users"
 	userservice "github.com/Gamequic/LivePreviewBackend/pkg/features/users/service"
+	"github.com/Gamequic/LivePreviewBackend/pkg/jwtkeys"
+	"github.com/Gamequic/LivePreviewBackend/pkg/mailer"
+	"github.com/Gamequic/LivePreviewBackend/pkg/passwords"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
+	"github.com/Gamequic/LivePreviewBackend/pkg/scope"
 	"github.com/Gamequic/LivePreviewBackend/pkg/session"
 
 	"github.com/gorilla/mux"
 )
 
 func RegisterSubRoutes(router *mux.Router) {
+	events.InitEvents()
+	mailer.InitMailer()
+	jwtkeys.InitJwtKeys()
+	passwords.InitPasswords()
 	userservice.InitUsersService()
 	authservice.InitAuthService()
+	apikeys.InitApiKeys()
 	profileservice.InitProfileService()
+	permissions.InitPermissions()
+	scope.InitScope()
 	session.InitSessionService()
 	notificationservice.InitNotificationsService()
 	pieceservice.InitPiecesService()
@@ -4,9 +4,14 @@ import (
 	"encoding/json"
 	"net/http"
 	"reflect"
+	"strconv"
 
 	authservice "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/service"
 	authstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/struct"
+	"github.com/Gamequic/LivePreviewBackend/pkg/jwtkeys"
+	"github.com/Gamequic/LivePreviewBackend/pkg/passwords"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
+	"github.com/Gamequic/LivePreviewBackend/utils"
 	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 
 	"github.com/gorilla/mux"
@@ -19,9 +24,46 @@ func LogIn(w http.ResponseWriter, r *http.Request) {
 
 	json.NewDecoder(r.Body).Decode(&user)
 
-	var token string = authservice.LogIn(&user)
+	metadata := authstruct.SessionMetadata{
+		IP:         utils.ClientIP(r),
+		UserAgent:  r.UserAgent(),
+		DeviceName: user.DeviceName,
+	}
+
+	// Users with two factor authentication get a challenge instead of the tokens
+	var response authstruct.LoginResponse = authservice.LogIn(&user, metadata)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// VerifyTwoFactorLogin exchanges the challenge of the login and a code for the tokens
+func VerifyTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var body authstruct.TwoFactorChallenge
+	json.NewDecoder(r.Body).Decode(&body)
+
+	var response authstruct.LoginResponse = authservice.VerifyLoginChallenge(body.ChallengeToken, body.Code)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// SetupTwoFactorLogin enrolls the users whose profile requires two factor authentication
+func SetupTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var body authstruct.TwoFactorChallengeSetup
+	json.NewDecoder(r.Body).Decode(&body)
+
+	var setup authstruct.TwoFactorSetup = authservice.SetupLoginChallenge(body.ChallengeToken)
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(token)
+	json.NewEncoder(w).Encode(setup)
+}
+
+// Refresh exchanges a refresh token for a new pair, the old refresh token stops working
+func Refresh(w http.ResponseWriter, r *http.Request) {
+	var body authstruct.RefreshRequest
+	json.NewDecoder(r.Body).Decode(&body)
+
+	var tokens authstruct.TokenPair = authservice.Refresh(body.RefreshToken)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
 }
 
 // ValidateToken checks if the token is valid and the session is active
@@ -51,9 +93,8 @@ func ValidateToken(w http.ResponseWriter, r *http.Request) {
 // New handlers for protected routes
 func Logout(w http.ResponseWriter, r *http.Request) {
 	userClaims := r.Context().Value(middlewares.UserKey).(*authstruct.TokenStruct)
-	tokenString := r.Context().Value(middlewares.UserTokenKey).(string)
 
-	err := authservice.Logout(userClaims.Id, tokenString)
+	err := authservice.Logout(userClaims.Id, userClaims.SessionID)
 	if err != nil {
 		panic(middlewares.GormError{
 			Code:    http.StatusInternalServerError,
@@ -80,10 +121,211 @@ func GetSessions(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
+	for i := range sessions {
+		sessions[i].Current = sessions[i].SessionID == userClaims.SessionID
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(sessions)
 }
 
+func RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var body authstruct.PasswordResetRequest
+	json.NewDecoder(r.Body).Decode(&body)
+
+	if err := authservice.RequestPasswordReset(body.Email); err != nil {
+		panic(middlewares.GormError{
+			Code:    http.StatusInternalServerError,
+			Message: "Error requesting password reset",
+			IsGorm:  false,
+		})
+	}
+
+	// Same answer for every email, registered or not
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If the email is registered you will receive a link to reset your password",
+	})
+}
+
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var body authstruct.PasswordReset
+	json.NewDecoder(r.Body).Decode(&body)
+
+	if err := authservice.ResetPassword(body.Token, body.NewPassword); err != nil {
+		panic(middlewares.GormError{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid or expired password reset token",
+			IsGorm:  true,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Password updated successfully",
+	})
+}
+
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var body authstruct.ChangePassword
+	json.NewDecoder(r.Body).Decode(&body)
+
+	authservice.ChangePassword(&body)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Password updated successfully",
+	})
+}
+
+// PasswordPolicy returns the rules, so the frontend can show them before sending the password
+func PasswordPolicy(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(passwords.Current())
+}
+
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userClaims := r.Context().Value(middlewares.UserKey).(*authstruct.TokenStruct)
+	sessionID := mux.Vars(r)["sessionId"]
+
+	authservice.RevokeSession(userClaims.Id, sessionID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Session revoked successfully",
+	})
+}
+
+func RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userClaims := r.Context().Value(middlewares.UserKey).(*authstruct.TokenStruct)
+
+	removed := authservice.RevokeOtherSessions(userClaims.Id, userClaims.SessionID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Other sessions revoked successfully",
+		"revoked": removed,
+	})
+}
+
+func ForceLogout(w http.ResponseWriter, r *http.Request) {
+	userClaims := r.Context().Value(middlewares.UserKey).(*authstruct.TokenStruct)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		panic(middlewares.GormError{Code: 400, Message: err.Error(), IsGorm: true})
+	}
+
+	authservice.ForceLogout(id, userClaims.Id)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "All sessions of the user were closed",
+	})
+}
+
+func UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	var body authstruct.UnlockAccount
+	json.NewDecoder(r.Body).Decode(&body)
+
+	if err := authservice.UnlockAccount(body.Email); err != nil {
+		panic(middlewares.GormError{
+			Code:    http.StatusInternalServerError,
+			Message: "Error unlocking account",
+			IsGorm:  false,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Account unlocked",
+	})
+}
+
+func SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userClaims := r.Context().Value(middlewares.UserKey).(*authstruct.TokenStruct)
+
+	var setup authstruct.TwoFactorSetup = authservice.SetupTwoFactor(uint(userClaims.Id))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(setup)
+}
+
+func EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userClaims := r.Context().Value(middlewares.UserKey).(*authstruct.TokenStruct)
+	var body authstruct.TwoFactorCode
+	json.NewDecoder(r.Body).Decode(&body)
+
+	recoveryCodes := authservice.EnableTwoFactor(uint(userClaims.Id), body.Code)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Two factor authentication enabled",
+		"recovery_codes": recoveryCodes,
+	})
+}
+
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userClaims := r.Context().Value(middlewares.UserKey).(*authstruct.TokenStruct)
+	var body authstruct.TwoFactorCode
+	json.NewDecoder(r.Body).Decode(&body)
+
+	authservice.DisableTwoFactor(uint(userClaims.Id), body.Code)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Two factor authentication disabled",
+	})
+}
+
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userClaims := r.Context().Value(middlewares.UserKey).(*authstruct.TokenStruct)
+	var body authstruct.TwoFactorCode
+	json.NewDecoder(r.Body).Decode(&body)
+
+	recoveryCodes := authservice.RegenerateRecoveryCodes(uint(userClaims.Id), body.Code)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recovery_codes": recoveryCodes,
+	})
+}
+
+func CreateApiKey(w http.ResponseWriter, r *http.Request) {
+	userClaims := r.Context().Value(middlewares.UserKey).(*authstruct.TokenStruct)
+	var body authstruct.CreateApiKey
+	json.NewDecoder(r.Body).Decode(&body)
+
+	var apiKey authstruct.ApiKeyCreated = authservice.CreateApiKey(uint(userClaims.Id), &body)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(apiKey)
+}
+
+func FindApiKeys(w http.ResponseWriter, r *http.Request) {
+	userClaims := r.Context().Value(middlewares.UserKey).(*authstruct.TokenStruct)
+
+	var apiKeys []authstruct.ApiKey = authservice.FindApiKeys(uint(userClaims.Id))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(apiKeys)
+}
+
+func RevokeApiKey(w http.ResponseWriter, r *http.Request) {
+	userClaims := r.Context().Value(middlewares.UserKey).(*authstruct.TokenStruct)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		panic(middlewares.GormError{Code: 400, Message: err.Error(), IsGorm: true})
+	}
+
+	authservice.RevokeApiKey(uint(userClaims.Id), uint(id))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "API key revoked",
+	})
+}
+
+// JWKS publishes the public keys so other services can verify our tokens
+func JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(jwtkeys.JWKS())
+}
+
 // Register function
 
 func RegisterSubRoutes(router *mux.Router) {
@@ -93,15 +335,74 @@ func RegisterSubRoutes(router *mux.Router) {
 	authLogInValidator := authRouter.NewRoute().Subrouter()
 	authLogInValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(authstruct.LogIn{})))
 
+	// ValidatorHandler for refresh
+	authRefreshValidator := authRouter.NewRoute().Subrouter()
+	authRefreshValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(authstruct.RefreshRequest{})))
+	authRefreshValidator.HandleFunc("/refresh", Refresh).Methods("POST")
+
+	// ValidatorHandler for password reset
+	passwordResetRequestValidator := authRouter.NewRoute().Subrouter()
+	passwordResetRequestValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(authstruct.PasswordResetRequest{})))
+	passwordResetRequestValidator.HandleFunc("/password/forgot", RequestPasswordReset).Methods("POST")
+
+	passwordResetValidator := authRouter.NewRoute().Subrouter()
+	passwordResetValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(authstruct.PasswordReset{})))
+	passwordResetValidator.HandleFunc("/password/reset", ResetPassword).Methods("POST")
+
+	passwordChangeValidator := authRouter.NewRoute().Subrouter()
+	passwordChangeValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(authstruct.ChangePassword{})))
+	passwordChangeValidator.HandleFunc("/password/change", ChangePassword).Methods("POST")
+
+	authRouter.HandleFunc("/password/policy", PasswordPolicy).Methods("GET")
+
+	// ValidatorHandler for the second step of the login
+	twoFactorLoginValidator := authRouter.NewRoute().Subrouter()
+	twoFactorLoginValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(authstruct.TwoFactorChallenge{})))
+	twoFactorLoginValidator.HandleFunc("/login/2fa", VerifyTwoFactorLogin).Methods("POST")
+
+	twoFactorLoginSetupValidator := authRouter.NewRoute().Subrouter()
+	twoFactorLoginSetupValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(authstruct.TwoFactorChallengeSetup{})))
+	twoFactorLoginSetupValidator.HandleFunc("/login/2fa/setup", SetupTwoFactorLogin).Methods("POST")
+
 	// Protected routes with AuthHandler
 	protectedRoutes := authRouter.NewRoute().Subrouter()
 	protectedRoutes.Use(middlewares.AuthHandler)
+	protectedRoutes.Use(middlewares.SessionOnlyHandler)
 
 	// Public endpoints (login)
 	authLogInValidator.HandleFunc("/login", LogIn).Methods("POST")
+	authRouter.HandleFunc("/.well-known/jwks.json", JWKS).Methods("GET")
 
 	// Protected endpoints
 	protectedRoutes.HandleFunc("/validate", ValidateToken).Methods("GET")
 	protectedRoutes.HandleFunc("/logout", Logout).Methods("POST")
 	protectedRoutes.HandleFunc("/sessions", GetSessions).Methods("GET")
+	protectedRoutes.HandleFunc("/sessions/others", RevokeOtherSessions).Methods("DELETE")
+	protectedRoutes.HandleFunc("/sessions/{sessionId}", RevokeSession).Methods("DELETE")
+	protectedRoutes.HandleFunc("/2fa/setup", SetupTwoFactor).Methods("POST")
+
+	twoFactorCodeValidator := protectedRoutes.NewRoute().Subrouter()
+	twoFactorCodeValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(authstruct.TwoFactorCode{})))
+	twoFactorCodeValidator.HandleFunc("/2fa/enable", EnableTwoFactor).Methods("POST")
+	twoFactorCodeValidator.HandleFunc("/2fa/disable", DisableTwoFactor).Methods("POST")
+	twoFactorCodeValidator.HandleFunc("/2fa/recovery-codes", RegenerateRecoveryCodes).Methods("POST")
+
+	// API keys for the integrations, they can not manage other keys
+	protectedRoutes.HandleFunc("/api-keys", FindApiKeys).Methods("GET")
+	protectedRoutes.HandleFunc("/api-keys/{id:[0-9]+}", RevokeApiKey).Methods("DELETE")
+
+	apiKeyCreateValidator := protectedRoutes.NewRoute().Subrouter()
+	apiKeyCreateValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(authstruct.CreateApiKey{})))
+	apiKeyCreateValidator.HandleFunc("/api-keys", CreateApiKey).Methods("POST")
+
+	// Admin endpoints
+	adminRoutes := authRouter.NewRoute().Subrouter()
+	adminRoutes.Use(middlewares.AuthHandler)
+	adminRoutes.Use(middlewares.SessionOnlyHandler)
+	adminRoutes.Use(middlewares.RequirePermission(permissions.AuthAdmin))
+	adminRoutes.HandleFunc("/users/{id}/sessions", ForceLogout).Methods("DELETE")
+
+	adminUnlockValidator := adminRoutes.NewRoute().Subrouter()
+	adminUnlockValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(authstruct.UnlockAccount{})))
+	adminUnlockValidator.HandleFunc("/unlock", UnlockAccount).Methods("POST")
 }
@@ -0,0 +1,134 @@
+package authservice
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/apikeys"
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	authstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/struct"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+
+	"gorm.io/gorm"
+)
+
+// Scopes that can not be given to a key
+var forbiddenApiKeyScopes = []string{"root"}
+
+func toApiKey(key *apikeys.ApiKeys) authstruct.ApiKey {
+	return authstruct.ApiKey{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.ScopeList(),
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		LastUsedIP: key.LastUsedIP,
+	}
+}
+
+// Scopes are profile names, a user can only give the profiles they have
+func validateApiKeyScopes(userId uint, scopes []string) []string {
+	var owned []string
+	database.DB.Raw(`
+		SELECT profiles.name
+		FROM profiles
+		JOIN user_profiles ON user_profiles.profile_id = profiles.id
+		WHERE user_profiles.user_id = ?
+	`, userId).Scan(&owned)
+
+	unique := map[string]bool{}
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+
+		for _, forbidden := range forbiddenApiKeyScopes {
+			if scope == forbidden {
+				panic(middlewares.GormError{Code: http.StatusBadRequest, Message: fmt.Sprintf("The scope %s can not be given to an API key", scope), IsGorm: true})
+			}
+		}
+
+		found := false
+		for _, name := range owned {
+			if strings.EqualFold(name, scope) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			panic(middlewares.GormError{Code: http.StatusForbidden, Message: fmt.Sprintf("You do not have the profile %s", scope), IsGorm: true})
+		}
+
+		unique[scope] = true
+	}
+
+	result := make([]string, 0, len(unique))
+	for scope := range unique {
+		result = append(result, scope)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// CreateApiKey returns the key in clear, only the hash is stored
+func CreateApiKey(userId uint, body *authstruct.CreateApiKey) authstruct.ApiKeyCreated {
+	scopes := validateApiKeyScopes(userId, body.Scopes)
+	key, prefix, keyHash := apikeys.Generate()
+
+	apiKey := apikeys.ApiKeys{
+		Name:    body.Name,
+		Prefix:  prefix,
+		KeyHash: keyHash,
+		Scopes:  strings.Join(scopes, ","),
+		UserID:  userId,
+	}
+	if body.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, body.ExpiresInDays)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	if err := database.DB.Create(&apiKey).Error; err != nil {
+		panic(err)
+	}
+
+	Logger.Info(fmt.Sprintf("User %d created the API key %s (%s) with scopes %s", userId, apiKey.Prefix, apiKey.Name, apiKey.Scopes))
+
+	return authstruct.ApiKeyCreated{
+		ApiKey: toApiKey(&apiKey),
+		Key:    key,
+	}
+}
+
+func FindApiKeys(userId uint) []authstruct.ApiKey {
+	var keys []apikeys.ApiKeys
+	if err := database.DB.Where("user_id = ?", userId).Order("created_at DESC").Find(&keys).Error; err != nil {
+		panic(err)
+	}
+
+	result := make([]authstruct.ApiKey, len(keys))
+	for i := range keys {
+		result[i] = toApiKey(&keys[i])
+	}
+	return result
+}
+
+// RevokeApiKey deletes a key of the user, it stops working immediately
+func RevokeApiKey(userId uint, id uint) {
+	var apiKey apikeys.ApiKeys
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userId).First(&apiKey).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			panic(middlewares.GormError{Code: http.StatusNotFound, Message: "API key not found", IsGorm: true})
+		}
+		panic(err)
+	}
+
+	if err := database.DB.Delete(&apiKey).Error; err != nil {
+		panic(err)
+	}
+
+	Logger.Info(fmt.Sprintf("User %d revoked the API key %s (%s)", userId, apiKey.Prefix, apiKey.Name))
+}
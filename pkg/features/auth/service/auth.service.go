@@ -2,12 +2,23 @@ package authservice
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Gamequic/LivePreviewBackend/pkg/database"
 	authstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/struct"
 	userservice "github.com/Gamequic/LivePreviewBackend/pkg/features/users/service"
+	"github.com/Gamequic/LivePreviewBackend/pkg/jwtkeys"
+	"github.com/Gamequic/LivePreviewBackend/pkg/mailer"
 	"github.com/Gamequic/LivePreviewBackend/pkg/session"
 	"github.com/Gamequic/LivePreviewBackend/utils"
 	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
@@ -16,40 +27,53 @@ import (
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
+// How long a password reset link can be used
+const PasswordResetTTL = 30 * time.Minute
+
+// Time to choose a new password after logging in with an expired one
+const PasswordChangeTTL = 10 * time.Minute
+
 var Logger *zap.Logger
 
 // Initialize the auth service
 func InitAuthService() {
 	Logger = utils.NewLogger()
+	initTOTPKey()
+	err := database.DB.AutoMigrate(&UserTwoFactor{}, &UserRecoveryCodes{})
+	if err != nil {
+		Logger.Error(fmt.Sprint("Failed to migrate database:", err))
+	}
 }
 
 // Auth Operations
 
-func LogIn(u *authstruct.LogIn) string {
-	var jwtKey = []byte(os.Getenv("JWTSECRET"))
-
-	// Check if user exists
-	var user userservice.Users
-	userservice.FindByEmail(&user, u.Email)
+// Access tokens live minutes, the refresh token keeps the session alive
+func accessTokenTTL() time.Duration {
+	minutes, err := strconv.Atoi(os.Getenv("ACCESS_TOKEN_TTL_MINUTES"))
+	if err != nil || minutes <= 0 {
+		minutes = 15
+	}
+	return time.Duration(minutes) * time.Minute
+}
 
-	// Check password
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(u.Password))
-	if err != nil {
-		if err.Error() == "crypto/bcrypt: hashedPassword is not the hash of the given password" {
-			panic(middlewares.GormError{Code: 401, Message: "Password is wrong", IsGorm: true})
-		}
-		panic(err.Error())
+func refreshTokenTTL() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("REFRESH_TOKEN_TTL_DAYS"))
+	if err != nil || days <= 0 {
+		days = 30
 	}
+	return time.Duration(days) * 24 * time.Hour
+}
 
+// Create the JWT with the current profiles of the user
+func createAccessToken(user *userservice.Users, sessionID string) (string, time.Time) {
 	// Load user profiles
 	var profiles []string
 	database.DB.Raw("SELECT profile_id FROM user_profiles WHERE user_id = ?", user.ID).Scan(&profiles)
 
-	// Create token
-	expirationTime := time.Now().AddDate(0, 6, 0) // six months
-	sessionID := uuid.New().String()              // Generate a new session ID
+	expirationTime := time.Now().Add(accessTokenTTL())
 	TokenData := &authstruct.TokenStruct{
 		Username:  user.Name,
 		Email:     user.Email,
@@ -58,78 +82,393 @@ func LogIn(u *authstruct.LogIn) string {
 		Profiles:  profiles,
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: expirationTime.Unix(),
+			IssuedAt:  time.Now().Unix(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, TokenData)
-	tokenString, err := token.SignedString(jwtKey)
+	// Signed with the active key of the set, the kid goes on the header
+	tokenString, err := jwtkeys.Sign(TokenData)
 	if err != nil {
 		panic(err)
 	}
 
-	// Store session in Redis using user ID as key
+	return tokenString, expirationTime
+}
+
+// The refresh token is opaque, it carries the session id so it can be found without scanning
+func createRefreshToken(sessionID string) (string, string) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	token := sessionID + "." + base64.RawURLEncoding.EncodeToString(bytes)
+	return token, hashRefreshToken(token)
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Compared when the email does not exist, so both failures take the same time
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+
+func LogIn(u *authstruct.LogIn, metadata authstruct.SessionMetadata) authstruct.LoginResponse {
+	user := checkCredentials(u.Email, u.Password, metadata)
+
+	// Self registered users confirm the email first
+	if user.EmailVerifiedAt == nil {
+		panic(middlewares.GormError{Code: http.StatusForbidden, Message: "Email not verified", IsGorm: true})
+	}
+	if user.DeactivatedAt != nil {
+		panic(middlewares.GormError{Code: http.StatusForbidden, Message: "Account deactivated", IsGorm: true})
+	}
+
+	// No session until the password is changed on /auth/password/change, the token for it is
+	// only given after the second factor
+	expired := userservice.PasswordExpired(&user)
+
+	// The session is opened once the second factor is verified
+	enabled, required := twoFactorStatus(user.ID)
+	if enabled || required {
+		return createLoginChallenge(&user, metadata, !enabled, expired)
+	}
+
+	if expired {
+		return passwordChangeResponse(&user)
+	}
+
+	tokens := openSession(&user, metadata)
+	return authstruct.LoginResponse{TokenPair: &tokens}
+}
+
+// checkCredentials finds the user of the email and checks the password, the failures count
+// for the lockout
+func checkCredentials(email string, password string, metadata authstruct.SessionMetadata) userservice.Users {
+	// Too many failures from the account or the address, otherwise the attempt is counted
+	failures := beginLoginAttempt(metadata.IP, email)
+
+	// Check if user exists, unknown emails get the same answer as a wrong password
+	var user userservice.Users
+	if err := database.DB.Where("email = ?", email).First(&user).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			panic(err)
+		}
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		registerLoginFailure(metadata.IP, email, failures, nil)
+		panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Email or password is wrong", IsGorm: true})
+	}
+
+	// Check password
+	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			registerLoginFailure(metadata.IP, email, failures, &user)
+			panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Email or password is wrong", IsGorm: true})
+		}
+		panic(err.Error())
+	}
+	clearLoginFailures(metadata.IP, email)
+
+	return user
+}
+
+// VerifyIdentity asks again for the credentials before changing them, the password and the
+// second factor when it is enabled. Wrong ones count for the lockout like on the login
+func VerifyIdentity(userId uint, password string, code string, ip string) {
+	if password == "" {
+		panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Current password is required", IsGorm: true})
+	}
+
+	var user userservice.Users
+	userservice.FindOne(&user, userId)
+	checkCredentials(user.Email, password, authstruct.SessionMetadata{IP: ip})
+
+	if enabled, _ := twoFactorStatus(userId); !enabled {
+		return
+	}
+	if code == "" {
+		panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Two factor code is required", IsGorm: true})
+	}
+
+	failures := beginLoginAttempt(ip, user.Email)
+	twoFactor, err := findTwoFactor(userId)
+	if err != nil {
+		panic(err)
+	}
+	if !verifySecondFactor(twoFactor, code) {
+		registerLoginFailure(ip, user.Email, failures, &user)
+		panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Invalid code", IsGorm: true})
+	}
+	clearLoginFailures(ip, user.Email)
+}
+
+// passwordChangeResponse answers the login of an expired password with a short lived token
+// that is only good for /auth/password/change
+func passwordChangeResponse(user *userservice.Users) authstruct.LoginResponse {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	token := hex.EncodeToString(bytes)
+
+	ctx := context.Background()
+	if err := database.RedisClient.Set(ctx, "pwd_change:"+token, user.ID, PasswordChangeTTL).Err(); err != nil {
+		panic(err)
+	}
+
+	return authstruct.LoginResponse{
+		PasswordExpired:         true,
+		PasswordChangeToken:     token,
+		PasswordChangeExpiresIn: int64(PasswordChangeTTL.Seconds()),
+	}
+}
+
+// ChangePassword replaces an expired password with the token given by the login, it works once.
+// Every session of the user is closed
+func ChangePassword(body *authstruct.ChangePassword) {
+	ctx := context.Background()
+	invalid := middlewares.GormError{Code: http.StatusUnauthorized, Message: "Invalid or expired password change token, log in again", IsGorm: true}
+	userId, err := database.RedisClient.Get(ctx, "pwd_change:"+body.Token).Int()
+	if err != nil {
+		panic(invalid)
+	}
+
+	var user userservice.Users
+	userservice.FindOne(&user, uint(userId), false) // the hash is compared with the new password
+	if user.DeactivatedAt != nil {
+		panic(middlewares.GormError{Code: http.StatusForbidden, Message: "Account deactivated", IsGorm: true})
+	}
+
+	// The token is spent only on a valid password, a rejected one can be corrected
+	hash := userservice.PasswordHash(&user, body.NewPassword)
+	if deleted, err := database.RedisClient.Del(ctx, "pwd_change:"+body.Token).Result(); err != nil || deleted == 0 {
+		panic(invalid)
+	}
+	userservice.SetPassword(&user, hash)
+
+	if err := session.RemoveAllSessions(int(user.ID)); err != nil {
+		Logger.Error("Error removing sessions after password change", zap.Error(err))
+	}
+	Logger.Info("Password changed", zap.String("email", user.Email))
+}
+
+// openSession creates the session of the user and its first pair of tokens
+func openSession(user *userservice.Users, metadata authstruct.SessionMetadata) authstruct.TokenPair {
+	// Create tokens
+	sessionID := uuid.New().String() // Generate a new session ID
+	tokenString, expirationTime := createAccessToken(user, sessionID)
+	refreshToken, refreshHash := createRefreshToken(sessionID)
+
+	// Store session in Redis, the token is not saved
+	deviceName := metadata.DeviceName
+	if deviceName == "" {
+		deviceName = utils.DeviceName(metadata.UserAgent)
+	}
 	sessionData := &authstruct.Session{
-		UserID:    int(user.ID),
-		Email:     user.Email,
-		Username:  user.Name,
-		Token:     tokenString,
-		SessionID: sessionID,
+		UserID:     int(user.ID),
+		Email:      user.Email,
+		Username:   user.Name,
+		SessionID:  sessionID,
+		IP:         metadata.IP,
+		UserAgent:  metadata.UserAgent,
+		DeviceName: deviceName,
+	}
+
+	// The session lives as long as its refresh token
+	err := session.StoreSession(int(user.ID), sessionData, refreshTokenTTL())
+	if err != nil {
+		panic(err)
 	}
 
-	err = session.StoreSession(int(user.ID), sessionData)
+	err = session.StoreRefreshToken(sessionID, int(user.ID), refreshHash, refreshTokenTTL())
 	if err != nil {
 		panic(err)
 	}
 
-	return tokenString
+	return authstruct.TokenPair{
+		AccessToken:  tokenString,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(time.Until(expirationTime).Seconds()),
+	}
+}
+
+// Refresh rotates the refresh token and issues a new access token for the same session
+func Refresh(refreshToken string) authstruct.TokenPair {
+	sessionID, _, found := strings.Cut(refreshToken, ".")
+	if !found || sessionID == "" {
+		panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Invalid refresh token", IsGorm: true})
+	}
+
+	newRefreshToken, newHash := createRefreshToken(sessionID)
+	userId, err := session.RotateRefreshToken(sessionID, hashRefreshToken(refreshToken), newHash, refreshTokenTTL())
+	if err != nil {
+		if errors.Is(err, session.ErrRefreshTokenReused) {
+			panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Refresh token reused, session revoked", IsGorm: true})
+		}
+		if errors.Is(err, session.ErrRefreshTokenInvalid) {
+			panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Invalid refresh token", IsGorm: true})
+		}
+		panic(err)
+	}
+
+	// The session could have been closed while the refresh token was still alive
+	if err := session.ValidateSession(sessionID, userId); err != nil {
+		session.RemoveRefreshToken(sessionID)
+		panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Session expired or invalid", IsGorm: true})
+	}
+	session.ExtendSession(sessionID, userId, refreshTokenTTL())
+
+	var user userservice.Users
+	userservice.FindOne(&user, uint(userId))
+
+	tokenString, expirationTime := createAccessToken(&user, sessionID)
+
+	return authstruct.TokenPair{
+		AccessToken:  tokenString,
+		RefreshToken: newRefreshToken,
+		ExpiresIn:    int64(time.Until(expirationTime).Seconds()),
+	}
 }
 
 func GetUserSessions(userId int) ([]authstruct.Session, error) {
 	return session.GetUserSessions(userId)
 }
 
-func Logout(userId int, tokenString string) error {
-	return session.RemoveSession(userId, tokenString)
+func Logout(userId int, sessionID string) error {
+	return session.RemoveSessionByID(userId, sessionID)
 }
 
 func ValidateSession(sessionID string, userID int) error {
 	return session.ValidateSession(sessionID, userID)
 }
 
-func ValidatePasswordResetToken(token string) (string, error) {
+// RevokeSession closes one session of the user, it has to be one of their own
+func RevokeSession(userId int, sessionID string) {
+	if err := session.ValidateSession(sessionID, userId); err != nil {
+		panic(middlewares.GormError{Code: http.StatusNotFound, Message: "Session not found", IsGorm: true})
+	}
+
+	if err := session.RemoveSessionByID(userId, sessionID); err != nil {
+		panic(err)
+	}
+}
+
+// RevokeOtherSessions closes every session of the user except the current one
+func RevokeOtherSessions(userId int, currentSessionID string) int {
+	removed, err := session.RemoveOtherSessions(userId, currentSessionID)
+	if err != nil {
+		panic(err)
+	}
+	return removed
+}
+
+// ForceLogout closes every session of any user, their websockets are disconnected too
+func ForceLogout(userId int, adminId int) {
+	// No autorize closing sessions of no existing users
+	var user userservice.Users
+	userservice.FindOne(&user, uint(userId))
+
+	if err := session.RemoveAllSessions(userId); err != nil {
+		panic(err)
+	}
+
+	Logger.Info(fmt.Sprintf("User %d closed all the sessions of user %d", adminId, userId))
+}
+
+// RequestPasswordReset emails a reset link. Unknown emails are ignored silently so the
+// endpoint does not tell which accounts exist.
+func RequestPasswordReset(email string) error {
+	var user userservice.Users
+	if err := database.DB.Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			Logger.Info("Password reset requested for unknown email", zap.String("email", email))
+			return nil
+		}
+		return err
+	}
+
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(bytes)
+
+	// Only the last requested link is valid
 	ctx := context.Background()
+	userKey := "pwd_reset_user:" + user.Email
+	if previous, err := database.RedisClient.Get(ctx, userKey).Result(); err == nil {
+		database.RedisClient.Del(ctx, "pwd_reset:"+previous)
+	}
+
+	if err := database.RedisClient.Set(ctx, "pwd_reset:"+token, user.Email, PasswordResetTTL).Err(); err != nil {
+		Logger.Error("Error storing password reset token", zap.Error(err))
+		return err
+	}
+	database.RedisClient.Set(ctx, userKey, token, PasswordResetTTL)
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", os.Getenv("FRONTEND_URL"), token)
+
+	// Sent in background, the response time must not depend on the email existing
+	go func() {
+		err := mailer.Send(mailer.Message{
+			To:      []string{user.Email},
+			Subject: "Password reset",
+			Text: fmt.Sprintf("Hi %s,\n\nUse the next link to choose a new password, it expires in %d minutes:\n\n%s\n\nIf you did not request it you can ignore this email.",
+				user.Name, int(PasswordResetTTL.Minutes()), link),
+		})
+		if err != nil {
+			Logger.Error("Error sending password reset email", zap.String("email", user.Email), zap.Error(err))
+		}
+	}()
 
-	email, err := database.RedisClient.Get(ctx, "pwd_reset:"+token).Result()
+	Logger.Info("Password reset requested", zap.String("email", user.Email))
+	return nil
+}
+
+// passwordResetEmail returns the email of the token, the token is kept until the new
+// password is valid
+func passwordResetEmail(token string) (string, error) {
+	email, err := database.RedisClient.Get(context.Background(), "pwd_reset:"+token).Result()
 	if err != nil {
 		Logger.Error("Invalid or expired password reset token", zap.Error(err))
 		return "", err
 	}
-
 	return email, nil
 }
 
-func ResetPassword(token string, newPassword string) error {
-	email, err := ValidatePasswordResetToken(token)
-	if err != nil {
-		return err
+// takePasswordResetToken deletes the token, false when it was already used. A link works once
+// even when it is sent twice at the same time
+func takePasswordResetToken(token string, email string) bool {
+	ctx := context.Background()
+	deleted, err := database.RedisClient.Del(ctx, "pwd_reset:"+token).Result()
+	if err != nil || deleted == 0 {
+		return false
 	}
+	database.RedisClient.Del(ctx, "pwd_reset_user:"+email)
+	return true
+}
 
-	// Hash new password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+func ResetPassword(token string, newPassword string) error {
+	email, err := passwordResetEmail(token)
 	if err != nil {
-		Logger.Error("Error hashing password", zap.Error(err))
 		return err
 	}
 
-	// Update user password in database
+	// The new password follows the policy and the history, a rejected one keeps the link working
 	var user userservice.Users
 	userservice.FindByEmail(&user, email)
-	user.Password = string(hashedPassword)
-	database.DB.Save(&user)
+	hash := userservice.PasswordHash(&user, newPassword)
 
-	// Delete reset token from Redis
-	ctx := context.Background()
-	database.RedisClient.Del(ctx, "pwd_reset:"+token)
+	if !takePasswordResetToken(token, email) {
+		return errors.New("password reset token already used")
+	}
+	userservice.SetPassword(&user, hash)
+
+	// Whoever had the old password is logged out
+	if err := session.RemoveAllSessions(int(user.ID)); err != nil {
+		Logger.Error("Error removing sessions after password reset", zap.Error(err))
+	}
 
 	Logger.Info("Password reset successful", zap.String("email", email))
 	return nil
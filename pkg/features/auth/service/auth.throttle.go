@@ -0,0 +1,204 @@
+package authservice
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	notificationservice "github.com/Gamequic/LivePreviewBackend/pkg/features/notifications/service"
+	userservice "github.com/Gamequic/LivePreviewBackend/pkg/features/users/service"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+/*
+	Brute force protection of the login, everything lives in Redis
+	login_fail:account:{email}   failed attempts of the account on the current window
+	login_fail:ip:{ip}           failed attempts from the address on the current window
+	login_delay:account:{email}  while it exists the account can not try again (progressive delay)
+	login_lock:account:{email}   while it exists the account is locked
+	Accounts are tracked by the email sent, registered or not, so the answers do not tell which exist.
+*/
+
+func envInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func loginDelayAfter() int    { return envInt("LOGIN_DELAY_AFTER", 3) }
+func loginMaxFailures() int   { return envInt("LOGIN_MAX_FAILURES", 10) }
+func loginMaxFailuresIP() int { return envInt("LOGIN_MAX_FAILURES_PER_IP", 50) }
+func loginLockout() time.Duration {
+	return time.Duration(envInt("LOGIN_LOCKOUT_MINUTES", 15)) * time.Minute
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Decides and counts an attempt in one step, so parallel requests can not all pass a check
+// made before any of them is counted. The attempt counts as a failure until the password
+// proves otherwise.
+// KEYS lock, ip failures, delay, account failures
+// ARGV max failures per ip, max failures, delay after, lockout ms
+// Returns {0, failures of the account} or {reason, ms to wait}, reason 1 locked, 2 address, 3 delay
+var loginAttemptScript = redis.NewScript(`
+local lock = redis.call('PTTL', KEYS[1])
+if lock > 0 then
+	return {1, lock}
+end
+if tonumber(redis.call('GET', KEYS[2]) or '0') >= tonumber(ARGV[1]) then
+	return {2, redis.call('PTTL', KEYS[2])}
+end
+local delay = redis.call('PTTL', KEYS[3])
+if delay > 0 then
+	return {3, delay}
+end
+if tonumber(redis.call('GET', KEYS[4]) or '0') >= tonumber(ARGV[2]) then
+	return {1, redis.call('PTTL', KEYS[4])}
+end
+
+if redis.call('INCR', KEYS[2]) == 1 then
+	redis.call('PEXPIRE', KEYS[2], ARGV[4])
+end
+local failures = redis.call('INCR', KEYS[4])
+if failures == 1 then
+	redis.call('PEXPIRE', KEYS[4], ARGV[4])
+end
+
+-- 1s, 2s, 4s ... after the first attempts, never more than the lockout
+local after = tonumber(ARGV[3])
+if failures >= after then
+	local wait = math.min(2 ^ (failures - after) * 1000, tonumber(ARGV[4]))
+	redis.call('SET', KEYS[3], failures, 'PX', wait)
+end
+return {0, failures}
+`)
+
+// Gives back the attempt of the address after a successful login, only failures count there
+var returnAttemptScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) then
+	return redis.call('DECR', KEYS[1])
+end
+return 0
+`)
+
+// beginLoginAttempt panics when the account or the address have to wait, otherwise counts the
+// attempt and returns the failures of the account including it. Without Redis the attempts can
+// not be counted, so nobody logs in rather than allowing unlimited guesses
+func beginLoginAttempt(ip string, email string) int {
+	ctx := context.Background()
+	email = normalizeEmail(email)
+
+	result, err := loginAttemptScript.Run(ctx, database.RedisClient,
+		[]string{"login_lock:account:" + email, "login_fail:ip:" + ip, "login_delay:account:" + email, "login_fail:account:" + email},
+		loginMaxFailuresIP(), loginMaxFailures(), loginDelayAfter(), loginLockout().Milliseconds(),
+	).Int64Slice()
+	if err != nil || len(result) != 2 {
+		Logger.Error("Error counting login attempt", zap.Error(err))
+		panic(middlewares.GormError{
+			Code:    http.StatusServiceUnavailable,
+			Message: "Login is not available right now, try again later",
+			IsGorm:  true,
+		})
+	}
+
+	wait := time.Duration(result[1]) * time.Millisecond
+	switch result[0] {
+	case 1:
+		panic(middlewares.GormError{
+			Code:    http.StatusLocked,
+			Message: fmt.Sprintf("Account temporarily locked, try again in %d minutes", int(math.Ceil(wait.Minutes()))),
+			IsGorm:  true,
+		})
+	case 2, 3:
+		panic(middlewares.GormError{
+			Code:    http.StatusTooManyRequests,
+			Message: fmt.Sprintf("Too many attempts, try again in %d seconds", int(math.Ceil(wait.Seconds()))),
+			IsGorm:  true,
+		})
+	}
+	return int(result[1])
+}
+
+// registerLoginFailure confirms a failed attempt, the account is locked when it reached the
+// maximum. user is nil when the email is not registered.
+func registerLoginFailure(ip string, email string, failures int, user *userservice.Users) {
+	if failures < loginMaxFailures() {
+		return
+	}
+
+	ctx := context.Background()
+	email = normalizeEmail(email)
+
+	database.RedisClient.Set(ctx, "login_lock:account:"+email, ip, loginLockout())
+	database.RedisClient.Del(ctx, "login_fail:account:"+email, "login_delay:account:"+email)
+	Logger.Warn("Account locked after failed logins", zap.String("email", email), zap.String("ip", ip), zap.Int("failures", failures))
+
+	if user != nil {
+		go notifyAccountLocked(user, ip, failures)
+	}
+}
+
+// clearLoginFailures resets the account after a successful login and gives the attempt back
+// to the address
+func clearLoginFailures(ip string, email string) {
+	ctx := context.Background()
+	email = normalizeEmail(email)
+	database.RedisClient.Del(ctx, "login_fail:account:"+email, "login_delay:account:"+email)
+	returnAttemptScript.Run(ctx, database.RedisClient, []string{"login_fail:ip:" + ip})
+}
+
+// UnlockAccount removes the lockout of an account before it expires
+func UnlockAccount(email string) error {
+	ctx := context.Background()
+	email = normalizeEmail(email)
+	return database.RedisClient.Del(ctx, "login_lock:account:"+email, "login_fail:account:"+email, "login_delay:account:"+email).Err()
+}
+
+// Tell the admins, it runs on background so a failure here never changes the login answer
+func notifyAccountLocked(user *userservice.Users, ip string, failures int) {
+	// Users that can unlock accounts
+	var adminIds []int
+	database.DB.Raw(`
+		SELECT DISTINCT user_profiles.user_id
+		FROM user_profiles
+		JOIN users ON users.id = user_profiles.user_id AND users.deleted_at IS NULL
+		JOIN profile_permissions ON profile_permissions.profile_id = user_profiles.profile_id
+		WHERE profile_permissions.permission IN ?
+	`, []string{permissions.AuthAdmin, permissions.All}).Scan(&adminIds)
+
+	message := fmt.Sprintf("The account %s was locked for %d minutes after %d failed login attempts, last one from %s",
+		user.Email, int(loginLockout().Minutes()), failures, ip)
+
+	for _, adminId := range adminIds {
+		notifyAdmin(adminId, message)
+	}
+}
+
+func notifyAdmin(adminId int, message string) {
+	// The notification service panics on errors
+	defer func() {
+		if err := recover(); err != nil {
+			Logger.Error("Error notifying account lockout", zap.Int("admin", adminId), zap.Any("error", err))
+		}
+	}()
+
+	notification := notificationservice.Notifications{
+		UserId:  adminId,
+		Message: message,
+	}
+	notificationservice.Create(&notification, 0)
+}
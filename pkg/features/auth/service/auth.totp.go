@@ -0,0 +1,590 @@
+package authservice
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	authstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/struct"
+	userservice "github.com/Gamequic/LivePreviewBackend/pkg/features/users/service"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+/*
+	Two factor authentication with TOTP (RFC 6238): SHA1, 6 digits, 30 seconds.
+	The secret is encrypted at rest and the recovery codes are stored hashed.
+	Login with 2FA: LogIn answers a challenge token, /auth/login/2fa exchanges it and a code for the tokens.
+*/
+
+const (
+	totpPeriod            = 30
+	totpDigits            = 6
+	totpSkew              = 1 // steps accepted before and after the current one
+	recoveryCodesCount    = 10
+	loginChallengeTTL     = 5 * time.Minute
+	loginChallengeMaxFail = 5
+)
+
+type UserTwoFactor struct {
+	gorm.Model
+	UserID       uint   `gorm:"uniqueIndex;not null"`
+	Secret       string `gorm:"not null"` // encrypted
+	Enabled      bool   `gorm:"default:false"`
+	LastUsedStep int64  // a code can not be used twice
+}
+
+type UserRecoveryCodes struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index;not null"`
+	CodeHash  string `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// Issuer shown on the authenticator apps
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "ArenasCRM"
+}
+
+// The key used to encrypt the secrets, if it changes every user has to enroll again.
+// Read once by InitAuthService
+var totpKey []byte
+
+func totpEncryptionKey() []byte {
+	return totpKey
+}
+
+// initTOTPKey panics when TOTP_ENCRYPTION_KEY is not set, the secrets would be readable
+func initTOTPKey() {
+	secret := os.Getenv("TOTP_ENCRYPTION_KEY")
+	if secret == "" {
+		panic(errors.New("TOTP_ENCRYPTION_KEY is required"))
+	}
+	key := sha256.Sum256([]byte(secret))
+	totpKey = key[:]
+}
+
+func encryptSecret(plain string) (string, error) {
+	block, err := aes.NewCipher(totpEncryptionKey())
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(gcm.Seal(nonce, nonce, []byte(plain), nil)), nil
+}
+
+func decryptSecret(encrypted string) (string, error) {
+	data, err := hex.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(totpEncryptionKey())
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("invalid secret")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func generateTOTPSecret() string {
+	bytes := make([]byte, 20)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(bytes)
+}
+
+// totpCode is the HOTP value (RFC 4226) of the step
+func totpCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// verifyTOTP returns the step that matched, steps up to lastUsedStep are rejected
+func verifyTOTP(secretBase32 string, code string, lastUsedStep int64) (int64, bool) {
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secretBase32))
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func provisioningURI(email string, secret string) string {
+	label := url.PathEscape(totpIssuer() + ":" + email)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer())
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToUpper(strings.ReplaceAll(strings.ReplaceAll(code, "-", ""), " ", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// Replace the recovery codes of the user, they are returned only here
+func generateRecoveryCodes(userId uint) []string {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodesCount)
+	records := make([]UserRecoveryCodes, recoveryCodesCount)
+
+	for i := range codes {
+		bytes := make([]byte, 6)
+		if _, err := rand.Read(bytes); err != nil {
+			panic(err)
+		}
+		raw := encoding.EncodeToString(bytes)[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+		records[i] = UserRecoveryCodes{UserID: userId, CodeHash: hashRecoveryCode(raw)}
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userId).Delete(&UserRecoveryCodes{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&records).Error
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return codes
+}
+
+func findTwoFactor(userId uint) (*UserTwoFactor, error) {
+	var twoFactor UserTwoFactor
+	if err := database.DB.Where("user_id = ?", userId).First(&twoFactor).Error; err != nil {
+		return nil, err
+	}
+	return &twoFactor, nil
+}
+
+// twoFactorStatus tells if the user has 2FA and if one of their profiles requires it
+func twoFactorStatus(userId uint) (bool, bool) {
+	enabled := false
+	if twoFactor, err := findTwoFactor(userId); err == nil {
+		enabled = twoFactor.Enabled
+	}
+
+	var required int64
+	database.DB.Raw(`
+		SELECT COUNT(*)
+		FROM user_profiles
+		JOIN profiles ON profiles.id = user_profiles.profile_id
+		WHERE user_profiles.user_id = ? AND profiles.require_two_factor = true
+	`, userId).Scan(&required)
+
+	return enabled, required > 0
+}
+
+// verifySecondFactor accepts a TOTP code or an unused recovery code
+func verifySecondFactor(twoFactor *UserTwoFactor, code string) bool {
+	secret, err := decryptSecret(twoFactor.Secret)
+	if err != nil {
+		Logger.Error("Error decrypting two factor secret", zap.Uint("user", twoFactor.UserID), zap.Error(err))
+		return false
+	}
+
+	if step, ok := verifyTOTP(secret, code, twoFactor.LastUsedStep); ok {
+		return useTOTPStep(twoFactor, step)
+	}
+
+	// Recovery codes are single use
+	now := time.Now()
+	result := database.DB.Model(&UserRecoveryCodes{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", twoFactor.UserID, hashRecoveryCode(code)).
+		Update("used_at", &now)
+	if result.Error == nil && result.RowsAffected > 0 {
+		Logger.Info("Recovery code used", zap.Uint("user", twoFactor.UserID))
+		return true
+	}
+
+	return false
+}
+
+// useTOTPStep marks the step as used, false when a parallel request already used it or a later one
+func useTOTPStep(twoFactor *UserTwoFactor, step int64) bool {
+	result := database.DB.Model(&UserTwoFactor{}).
+		Where("id = ? AND last_used_step < ?", twoFactor.ID, step).
+		Update("last_used_step", step)
+	if result.Error != nil {
+		Logger.Error("Error saving two factor step", zap.Uint("user", twoFactor.UserID), zap.Error(result.Error))
+		return false
+	}
+	if result.RowsAffected == 0 {
+		return false
+	}
+	twoFactor.LastUsedStep = step
+	return true
+}
+
+// SetupTwoFactor creates a new secret for the user, it is not used until it is enabled with a code
+func SetupTwoFactor(userId uint) authstruct.TwoFactorSetup {
+	var user userservice.Users
+	userservice.FindOne(&user, userId)
+
+	twoFactor, err := findTwoFactor(userId)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		panic(err)
+	}
+	if twoFactor != nil && twoFactor.Enabled {
+		panic(middlewares.GormError{Code: http.StatusConflict, Message: "Two factor authentication is already enabled", IsGorm: true})
+	}
+
+	secret := generateTOTPSecret()
+	encrypted, err := encryptSecret(secret)
+	if err != nil {
+		panic(err)
+	}
+
+	if twoFactor == nil {
+		twoFactor = &UserTwoFactor{UserID: userId}
+	}
+	twoFactor.Secret = encrypted
+	twoFactor.Enabled = false
+	twoFactor.LastUsedStep = 0
+	if err := database.DB.Save(twoFactor).Error; err != nil {
+		panic(err)
+	}
+
+	return authstruct.TwoFactorSetup{
+		Secret:          secret,
+		ProvisioningURI: provisioningURI(user.Email, secret),
+	}
+}
+
+// EnableTwoFactor confirms the enrollment with a code and returns the recovery codes
+func EnableTwoFactor(userId uint, code string) []string {
+	twoFactor, err := findTwoFactor(userId)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Two factor authentication was not set up", IsGorm: true})
+		}
+		panic(err)
+	}
+	if twoFactor.Enabled {
+		panic(middlewares.GormError{Code: http.StatusConflict, Message: "Two factor authentication is already enabled", IsGorm: true})
+	}
+
+	secret, err := decryptSecret(twoFactor.Secret)
+	if err != nil {
+		panic(err)
+	}
+	step, ok := verifyTOTP(secret, code, twoFactor.LastUsedStep)
+	if !ok {
+		panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Invalid code", IsGorm: true})
+	}
+
+	// Only one request enables it, with a code not used before
+	result := database.DB.Model(&UserTwoFactor{}).
+		Where("id = ? AND enabled = ? AND last_used_step < ?", twoFactor.ID, false, step).
+		Updates(map[string]interface{}{"enabled": true, "last_used_step": step})
+	if result.Error != nil {
+		panic(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Invalid code", IsGorm: true})
+	}
+
+	Logger.Info(fmt.Sprintf("User %d enabled two factor authentication", userId))
+	return generateRecoveryCodes(userId)
+}
+
+// DisableTwoFactor removes 2FA, not allowed when a profile of the user requires it
+func DisableTwoFactor(userId uint, code string) {
+	twoFactor, err := findTwoFactor(userId)
+	if err != nil || !twoFactor.Enabled {
+		panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Two factor authentication is not enabled", IsGorm: true})
+	}
+
+	if _, required := twoFactorStatus(userId); required {
+		panic(middlewares.GormError{Code: http.StatusForbidden, Message: "Two factor authentication is required for your profile", IsGorm: true})
+	}
+
+	if !verifySecondFactor(twoFactor, code) {
+		panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Invalid code", IsGorm: true})
+	}
+
+	database.DB.Unscoped().Delete(twoFactor)
+	database.DB.Where("user_id = ?", userId).Delete(&UserRecoveryCodes{})
+
+	Logger.Info(fmt.Sprintf("User %d disabled two factor authentication", userId))
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes, the old ones stop working
+func RegenerateRecoveryCodes(userId uint, code string) []string {
+	twoFactor, err := findTwoFactor(userId)
+	if err != nil || !twoFactor.Enabled {
+		panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Two factor authentication is not enabled", IsGorm: true})
+	}
+
+	if !verifySecondFactor(twoFactor, code) {
+		panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Invalid code", IsGorm: true})
+	}
+
+	return generateRecoveryCodes(userId)
+}
+
+// Login challenges
+
+func challengeKey(token string) string {
+	return "2fa_challenge:" + token
+}
+
+// createLoginChallenge asks for the second factor, passwordChange when the password expired and
+// the challenge ends with the token to change it instead of a session
+func createLoginChallenge(user *userservice.Users, metadata authstruct.SessionMetadata, setup bool, passwordChange bool) authstruct.LoginResponse {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	token := hex.EncodeToString(bytes)
+
+	ctx := context.Background()
+	key := challengeKey(token)
+	err := database.RedisClient.HSet(ctx, key,
+		"user_id", user.ID,
+		"ip", metadata.IP,
+		"user_agent", metadata.UserAgent,
+		"device_name", metadata.DeviceName,
+		"setup", setup,
+		"password_change", passwordChange,
+		"failures", 0,
+	).Err()
+	if err != nil {
+		panic(err)
+	}
+	database.RedisClient.Expire(ctx, key, loginChallengeTTL)
+
+	return authstruct.LoginResponse{
+		TwoFactorRequired:      true,
+		TwoFactorSetupRequired: setup,
+		ChallengeToken:         token,
+		ChallengeExpiresIn:     int64(loginChallengeTTL.Seconds()),
+	}
+}
+
+// Takes the fields of the challenge and deletes it in one step, with the time it had left
+var takeChallengeScript = redis.NewScript(`
+local fields = redis.call('HGETALL', KEYS[1])
+if #fields == 0 then
+	return fields
+end
+table.insert(fields, 'ttl')
+table.insert(fields, tostring(redis.call('PTTL', KEYS[1])))
+redis.call('DEL', KEYS[1])
+return fields
+`)
+
+func getLoginChallenge(token string) (map[string]string, uint) {
+	ctx := context.Background()
+	fields, err := database.RedisClient.HGetAll(ctx, challengeKey(token)).Result()
+	if err != nil {
+		panic(err)
+	}
+
+	return fields, challengeUser(fields)
+}
+
+// takeLoginChallenge removes the challenge while its code is checked, a parallel request with
+// the same token finds nothing. The caller puts it back when the code is wrong
+func takeLoginChallenge(token string) (map[string]string, uint, time.Duration) {
+	ctx := context.Background()
+	values, err := takeChallengeScript.Run(ctx, database.RedisClient, []string{challengeKey(token)}).StringSlice()
+	if err != nil {
+		panic(err)
+	}
+
+	fields := map[string]string{}
+	for i := 0; i+1 < len(values); i += 2 {
+		fields[values[i]] = values[i+1]
+	}
+	ttl, _ := strconv.ParseInt(fields["ttl"], 10, 64)
+	delete(fields, "ttl")
+
+	return fields, challengeUser(fields), time.Duration(ttl) * time.Millisecond
+}
+
+// restoreLoginChallenge puts a challenge back with the time it had left, unless it ran out of attempts
+func restoreLoginChallenge(token string, fields map[string]string, failures int, ttl time.Duration) {
+	if failures >= loginChallengeMaxFail || ttl <= 0 {
+		return
+	}
+
+	ctx := context.Background()
+	key := challengeKey(token)
+	values := []interface{}{}
+	for field, value := range fields {
+		if field != "failures" {
+			values = append(values, field, value)
+		}
+	}
+	values = append(values, "failures", failures)
+
+	_, err := database.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, values...)
+		pipe.PExpire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		Logger.Error("Error restoring login challenge", zap.Error(err))
+	}
+}
+
+func challengeUser(fields map[string]string) uint {
+	userId, err := strconv.Atoi(fields["user_id"])
+	if len(fields) == 0 || err != nil {
+		panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Challenge expired, log in again", IsGorm: true})
+	}
+	return uint(userId)
+}
+
+// SetupLoginChallenge is the enrollment for users whose profile requires 2FA and do not have it yet
+func SetupLoginChallenge(token string) authstruct.TwoFactorSetup {
+	fields, userId := getLoginChallenge(token)
+	if fields["setup"] != "1" {
+		panic(middlewares.GormError{Code: http.StatusConflict, Message: "Two factor authentication is already enabled", IsGorm: true})
+	}
+
+	return SetupTwoFactor(userId)
+}
+
+// VerifyLoginChallenge checks the code and opens the session
+func VerifyLoginChallenge(token string, code string) authstruct.LoginResponse {
+	fields, userId, ttl := takeLoginChallenge(token)
+
+	// Anything but a completed login gives the challenge back, with the wrong codes counted
+	completed := false
+	challengeFailures, _ := strconv.Atoi(fields["failures"])
+	defer func() {
+		if !completed {
+			restoreLoginChallenge(token, fields, challengeFailures, ttl)
+		}
+	}()
+
+	var user userservice.Users
+	userservice.FindOne(&user, userId)
+
+	metadata := authstruct.SessionMetadata{
+		IP:         fields["ip"],
+		UserAgent:  fields["user_agent"],
+		DeviceName: fields["device_name"],
+	}
+
+	// A code is an attempt of login, so the lockout applies to the codes too
+	failures := beginLoginAttempt(metadata.IP, user.Email)
+	fail := func() {
+		registerLoginFailure(metadata.IP, user.Email, failures, &user)
+		challengeFailures++
+		panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Invalid code", IsGorm: true})
+	}
+
+	var recoveryCodes []string
+	if fields["setup"] == "1" {
+		// First code of the enrollment, it enables 2FA
+		twoFactor, err := findTwoFactor(userId)
+		if err != nil {
+			panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Two factor authentication was not set up", IsGorm: true})
+		}
+		secret, err := decryptSecret(twoFactor.Secret)
+		if err != nil {
+			panic(err)
+		}
+		if _, ok := verifyTOTP(secret, code, twoFactor.LastUsedStep); !ok {
+			fail()
+		}
+		recoveryCodes = EnableTwoFactor(userId, code)
+	} else {
+		twoFactor, err := findTwoFactor(userId)
+		if err != nil || !twoFactor.Enabled {
+			panic(middlewares.GormError{Code: http.StatusUnauthorized, Message: "Challenge expired, log in again", IsGorm: true})
+		}
+		if !verifySecondFactor(twoFactor, code) {
+			fail()
+		}
+	}
+
+	completed = true
+	clearLoginFailures(metadata.IP, user.Email)
+
+	if fields["password_change"] == "1" {
+		response := passwordChangeResponse(&user)
+		response.RecoveryCodes = recoveryCodes
+		return response
+	}
+
+	tokens := openSession(&user, metadata)
+	return authstruct.LoginResponse{
+		TokenPair:     &tokens,
+		RecoveryCodes: recoveryCodes,
+	}
+}
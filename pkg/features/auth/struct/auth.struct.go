@@ -1,6 +1,10 @@
 package authstruct
 
-import "github.com/golang-jwt/jwt"
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
 
 type TokenStruct struct {
 	jwt.StandardClaims
@@ -9,20 +13,77 @@ type TokenStruct struct {
 	Id        int      `json:"id"`
 	SessionID string   `json:"session_id"`
 	Profiles  []string `json:"profiles"`
+	ApiKeyID  uint     `json:"-"` // set when the request was authenticated with an API key
 }
 
 type LogIn struct {
-	Email    string `validate:"required,email" json:"email"`
-	Password string `validate:"required,min=8" json:"password"`
+	Email      string `validate:"required,email" json:"email"`
+	Password   string `validate:"required,min=8" json:"password"`
+	DeviceName string `validate:"omitempty,max=100" json:"device_name"` // optional, guessed from the user agent if empty
+}
+
+// Answer of login and refresh, the access token is short lived
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // seconds until the access token expires
+}
+
+// Answer of login, when the user has two factor authentication the tokens are replaced
+// by a challenge that is completed on /auth/login/2fa
+type LoginResponse struct {
+	*TokenPair
+	TwoFactorRequired       bool     `json:"two_factor_required,omitempty"`
+	TwoFactorSetupRequired  bool     `json:"two_factor_setup_required,omitempty"` // a profile of the user requires it and it is not enabled yet
+	ChallengeToken          string   `json:"challenge_token,omitempty"`
+	ChallengeExpiresIn      int64    `json:"challenge_expires_in,omitempty"`
+	RecoveryCodes           []string `json:"recovery_codes,omitempty"`        // only when the setup is completed on login
+	PasswordExpired         bool     `json:"password_expired,omitempty"`      // no tokens, the password is changed on /auth/password/change
+	PasswordChangeToken     string   `json:"password_change_token,omitempty"` // given with PasswordExpired once the second factor is verified
+	PasswordChangeExpiresIn int64    `json:"password_change_expires_in,omitempty"`
+}
+
+type TwoFactorChallenge struct {
+	ChallengeToken string `validate:"required" json:"challenge_token"`
+	Code           string `validate:"required" json:"code"` // TOTP code or recovery code
+}
+
+type TwoFactorChallengeSetup struct {
+	ChallengeToken string `validate:"required" json:"challenge_token"`
+}
+
+type TwoFactorCode struct {
+	Code string `validate:"required" json:"code"`
+}
+
+// Secret of a new enrollment, the uri is the one rendered as QR code
+type TwoFactorSetup struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `validate:"required" json:"refresh_token"`
 }
 
 type Session struct {
-	UserID    int    `json:"user_id"`
-	Email     string `json:"email"`
-	Username  string `json:"username"`
-	Token     string `json:"token"`
-	CreateAt  string `json:"create_at,omitempty"`
-	SessionID string `json:"session_id"`
+	UserID     int    `json:"user_id"`
+	Email      string `json:"email"`
+	Username   string `json:"username"`
+	SessionID  string `json:"session_id"`
+	CreatedAt  string `json:"created_at"`
+	LastSeen   string `json:"last_seen"`
+	IP         string `json:"ip"`
+	UserAgent  string `json:"user_agent"`
+	DeviceName string `json:"device_name"`
+	Current    bool   `json:"current"` // the session of the token used for the request, not stored
+}
+
+// Data of the request that opened the session
+type SessionMetadata struct {
+	IP         string
+	UserAgent  string
+	DeviceName string
 }
 
 type PasswordResetRequest struct {
@@ -33,3 +94,36 @@ type PasswordReset struct {
 	Token       string `validate:"required" json:"token"`
 	NewPassword string `validate:"required,min=8" json:"new_password"`
 }
+
+// Change of an expired password, the token is the one given by the login
+type ChangePassword struct {
+	Token       string `validate:"required" json:"token"`
+	NewPassword string `validate:"required,min=8" json:"new_password"`
+}
+
+type UnlockAccount struct {
+	Email string `validate:"required,email" json:"email"`
+}
+
+type CreateApiKey struct {
+	Name          string   `validate:"required,max=100" json:"name"`
+	Scopes        []string `validate:"required,min=1,dive,required" json:"scopes"`     // profile names
+	ExpiresInDays int      `validate:"omitempty,min=1,max=730" json:"expires_in_days"` // 0 never expires
+}
+
+type ApiKey struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip"`
+}
+
+// Answer of the creation, the key is only shown here
+type ApiKeyCreated struct {
+	ApiKey
+	Key string `json:"key"`
+}
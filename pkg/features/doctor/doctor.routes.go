@@ -5,6 +5,8 @@ import (
 	"net/http"
 
 	doctorservice "github.com/Gamequic/LivePreviewBackend/pkg/features/doctor/service"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
@@ -31,7 +33,7 @@ var logger *zap.Logger
 func find(w http.ResponseWriter, r *http.Request) {
 	//Service
 	var doctors []doctorservice.Doctor
-	var httpsResponse int = doctorservice.Find(&doctors)
+	var httpsResponse int = doctorservice.Find(&doctors, middlewares.UserScope(r))
 
 	//Https response
 	w.WriteHeader(httpsResponse)
@@ -82,7 +84,7 @@ func find(w http.ResponseWriter, r *http.Request) {
 
 func RegisterSubRoutes(router *mux.Router) {
 	piecesRouter := router.PathPrefix("/doctor").Subrouter()
-	// piecesRouter.Use(middlewares.AuthHandler)
+	piecesRouter.Use(middlewares.AuthHandler)
 
 	// ValidatorHandler - Update
 	// usersUpdateValidator := piecesRouter.NewRoute().Subrouter()
@@ -97,7 +99,7 @@ func RegisterSubRoutes(router *mux.Router) {
 
 	// Protected functions
 	piecesProtected := piecesRouter.NewRoute().Subrouter()
-	// piecesProtected.Use(middlewares.ProfilesHandler([]uint{1, 2, 4}))
+	piecesProtected.Use(middlewares.RequirePermission(permissions.DoctorsRead))
 	piecesProtected.HandleFunc("/", find).Methods("GET")
 	// piecesProtected.HandleFunc("/{id}", findOne).Methods("GET")
 	// piecesProtected.HandleFunc("/{id}", delete).Methods("DELETE")
@@ -7,6 +7,7 @@ import (
 
 	"github.com/Gamequic/LivePreviewBackend/pkg/database"
 	hospitalservice "github.com/Gamequic/LivePreviewBackend/pkg/features/hospital/service"
+	"github.com/Gamequic/LivePreviewBackend/pkg/scope"
 	"github.com/Gamequic/LivePreviewBackend/utils"
 	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 
@@ -53,8 +54,17 @@ func Create(Piece *Doctor) int {
 	return http.StatusOK
 }
 
-func Find(Doctor *[]Doctor) int {
-	if err := database.DB.Find(Doctor).Error; err != nil {
+// Find returns the doctors of the scope, a hospital sees the doctors that work there
+func Find(Doctor *[]Doctor, sc scope.Scope) int {
+	query := database.DB
+	if !sc.Global {
+		query = query.Where(
+			"id IN ? OR id IN (SELECT doctor_id FROM doctor_hospitals WHERE hospital_id IN ?)",
+			sc.DoctorIDsOrNone(), sc.HospitalIDsOrNone(),
+		)
+	}
+
+	if err := query.Find(Doctor).Error; err != nil {
 		panic(middlewares.GormError{
 			Code:    http.StatusInternalServerError,
 			Message: "Error retrieving doctor",
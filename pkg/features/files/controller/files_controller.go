@@ -1,12 +1,15 @@
 package filescontroller
 
 import (
-	"fmt"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 
 	fileservice "github.com/Gamequic/LivePreviewBackend/pkg/features/files/service"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 	"github.com/gorilla/mux"
 )
 
@@ -15,6 +18,12 @@ func GetFile(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	filename := vars["filename"]
 
+	// Outside the scope the file does not exist
+	if !fileservice.CanAccessFile(filename, middlewares.UserScope(r)) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
 	filepath, err := fileservice.GetFilePath(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -25,9 +34,35 @@ func GetFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Never let the browser guess the type of an uploaded file
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 	http.ServeFile(w, r, filepath)
 }
 
+// GET /files/{id}/thumbnail
+func GetThumbnail(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	thumbPath, err := fileservice.GetThumbnailPath(uint(id), middlewares.UserScope(r))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Thumbnail not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, thumbPath)
+}
+
 // POST /files/upload
 func UploadFile(w http.ResponseWriter, r *http.Request) {
 	// Limitar tamaño del archivo (ej: 10MB)
@@ -45,21 +80,44 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	filename := filepath.Base(handler.Filename)
-	filepath := filepath.Join(fileservice.UploadsPath, filename)
-
-	dst, err := os.Create(filepath)
+	data, err := io.ReadAll(file)
 	if err != nil {
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		http.Error(w, "Error reading file", http.StatusBadRequest)
 		return
 	}
-	defer dst.Close()
 
-	if _, err := dst.ReadFrom(file); err != nil {
-		http.Error(w, "Error writing file", http.StatusInternalServerError)
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	// Optional, the file is shared with who can see the piece
+	var pieceId *uint
+	if value := r.FormValue("piece_id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || id == 0 {
+			http.Error(w, "Invalid piece_id", http.StatusBadRequest)
+			return
+		}
+		if err := fileservice.CheckPiece(uint(id), middlewares.UserScope(r)); err != nil {
+			if errors.Is(err, fileservice.ErrPieceNotFound) {
+				http.Error(w, "Piece not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		piece := uint(id)
+		pieceId = &piece
+	}
+
+	saved, err := fileservice.SaveFile(data, handler.Filename, userId, pieceId)
+	if err != nil {
+		if errors.Is(err, fileservice.ErrMimeTypeNotAllowed) {
+			http.Error(w, "Only images and PDF files are allowed", http.StatusUnsupportedMediaType)
+			return
+		}
+		http.Error(w, "Error saving file", http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, "File uploaded successfully: %s\n", filename)
+	json.NewEncoder(w).Encode(saved)
 }
@@ -0,0 +1,76 @@
+package filescontroller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	fileservice "github.com/Gamequic/LivePreviewBackend/pkg/features/files/service"
+	filesstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/files/struct"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+	"github.com/gorilla/mux"
+)
+
+// POST /files/{filename}/link
+func CreateSignedLink(w http.ResponseWriter, r *http.Request) {
+	filename := mux.Vars(r)["filename"]
+
+	// Only the files inside the scope can be shared
+	if !fileservice.CanAccessFile(filename, middlewares.UserScope(r)) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	var body filesstruct.CreateSignedLink
+
+	/*
+		This error is alredy been check it on middlewares.ValidatorHandler
+		utils/middlewares/validatorHandler.go:29:68
+	*/
+	json.NewDecoder(r.Body).Decode(&body)
+
+	link, err := fileservice.CreateSignedLink(filename, time.Duration(body.ExpiresIn)*time.Second, body.SingleUse)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(link)
+}
+
+// GET /files/signed/{filename}, public, the signature is the credential
+func GetSignedFile(w http.ResponseWriter, r *http.Request) {
+	filename := mux.Vars(r)["filename"]
+	query := r.URL.Query()
+
+	fullPath, err := fileservice.VerifySignedLink(filename, query.Get("expires"), query.Get("nonce"), query.Get("signature"))
+	if err != nil {
+		switch {
+		case errors.Is(err, fileservice.ErrInvalidSignature):
+			http.Error(w, "Invalid link", http.StatusForbidden)
+		case errors.Is(err, fileservice.ErrLinkExpired), errors.Is(err, fileservice.ErrLinkAlreadyUsed):
+			http.Error(w, "Link expired", http.StatusGone)
+		case os.IsNotExist(err):
+			http.Error(w, "File not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Single use links can not be cached by proxies
+	if query.Get("nonce") != "" {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		w.Header().Set("Cache-Control", "private")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, fullPath)
+}
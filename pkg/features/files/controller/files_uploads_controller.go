@@ -0,0 +1,152 @@
+package filescontroller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	fileservice "github.com/Gamequic/LivePreviewBackend/pkg/features/files/service"
+	filesstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/files/struct"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+	"github.com/gorilla/mux"
+)
+
+/*
+	Resumable uploads (tus style)
+	1. POST   /files/uploads               -> creates the upload, returns its ID
+	2. PATCH  /files/uploads/{id}          -> appends a chunk, Upload-Offset header must match the progress
+	3. HEAD   /files/uploads/{id}          -> returns the progress on Upload-Offset, used to resume
+	4. POST   /files/uploads/{id}/finalize -> verifies the checksum and stores the file
+*/
+
+// Write the response for the errors of the upload service
+func uploadError(w http.ResponseWriter, upload *fileservice.FileUploads, err error) {
+	switch {
+	case errors.Is(err, fileservice.ErrUploadNotFound):
+		http.Error(w, "Upload not found", http.StatusNotFound)
+	case errors.Is(err, fileservice.ErrPieceNotFound):
+		http.Error(w, "Piece not found", http.StatusNotFound)
+	case errors.Is(err, fileservice.ErrUploadTooBig):
+		http.Error(w, "File too big", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, fileservice.ErrImageTooLarge):
+		http.Error(w, "Image too big to process, upload discarded", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, fileservice.ErrOffsetMismatch):
+		if upload != nil {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		}
+		http.Error(w, "Upload-Offset does not match the upload progress", http.StatusConflict)
+	case errors.Is(err, fileservice.ErrUploadIncomplete):
+		http.Error(w, "Upload is not complete", http.StatusConflict)
+	case errors.Is(err, fileservice.ErrChecksumMismatch):
+		http.Error(w, "Checksum does not match, upload discarded", http.StatusUnprocessableEntity)
+	case errors.Is(err, fileservice.ErrMimeTypeNotAllowed):
+		http.Error(w, "Only images and PDF files are allowed", http.StatusUnsupportedMediaType)
+	default:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// POST /files/uploads
+func CreateUpload(w http.ResponseWriter, r *http.Request) {
+	var body filesstruct.CreateUpload
+
+	/*
+		This error is alredy been check it on middlewares.ValidatorHandler
+		utils/middlewares/validatorHandler.go:29:68
+	*/
+	json.NewDecoder(r.Body).Decode(&body)
+
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	var pieceId *uint
+	if body.PieceId != 0 {
+		if err := fileservice.CheckPiece(body.PieceId, middlewares.UserScope(r)); err != nil {
+			uploadError(w, nil, err)
+			return
+		}
+		pieceId = &body.PieceId
+	}
+
+	upload, err := fileservice.CreateUpload(body.Filename, body.Size, body.Checksum, userId, pieceId)
+	if err != nil {
+		uploadError(w, nil, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/files/uploads/"+upload.ID)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(upload)
+}
+
+// HEAD /files/uploads/{id}
+func UploadStatus(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	upload, err := fileservice.GetUpload(id, userId)
+	if err != nil {
+		uploadError(w, nil, err)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// PATCH /files/uploads/{id}
+func UploadChunk(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+
+	upload, err := fileservice.WriteChunk(id, userId, offset, r.Body)
+	if err != nil {
+		uploadError(w, upload, err)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /files/uploads/{id}/finalize
+func FinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	file, err := fileservice.FinalizeUpload(id, userId)
+	if err != nil {
+		uploadError(w, nil, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(file)
+}
+
+// DELETE /files/uploads/{id}
+func CancelUpload(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	if err := fileservice.CancelUpload(id, userId); err != nil {
+		uploadError(w, nil, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,8 +1,12 @@
 package files
 
 import (
+	"reflect"
+
 	filescontroller "github.com/Gamequic/LivePreviewBackend/pkg/features/files/controller"
 	fileservice "github.com/Gamequic/LivePreviewBackend/pkg/features/files/service"
+	filesstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/files/struct"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
 	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 	"github.com/gorilla/mux"
 )
@@ -10,11 +14,38 @@ import (
 func RegisterFileRoutes(router *mux.Router) {
 	// Crear carpeta al inicializar
 	fileservice.CreateUploadsFolder()
+	fileservice.StartUploadsJanitor()
+
+	// Signed links, the signature replaces the Authorization header
+	signedRouter := router.PathPrefix("/files/signed").Subrouter()
+	signedRouter.HandleFunc("/{filename}", filescontroller.GetSignedFile).Methods("GET")
 
 	// Subrouter protegido
 	filesRouter := router.PathPrefix("/files").Subrouter()
 	filesRouter.Use(middlewares.AuthHandler)
 
-	filesRouter.HandleFunc("/{filename}", filescontroller.GetFile).Methods("GET")
-	filesRouter.HandleFunc("/upload", filescontroller.UploadFile).Methods("POST")
+	filesRead := filesRouter.NewRoute().Subrouter()
+	filesRead.Use(middlewares.RequirePermission(permissions.FilesRead))
+	filesRead.HandleFunc("/{filename}", filescontroller.GetFile).Methods("GET")
+	filesRead.HandleFunc("/{id:[0-9]+}/thumbnail", filescontroller.GetThumbnail).Methods("GET")
+
+	filesWrite := filesRouter.NewRoute().Subrouter()
+	filesWrite.Use(middlewares.RequirePermission(permissions.FilesWrite))
+	filesWrite.HandleFunc("/upload", filescontroller.UploadFile).Methods("POST")
+
+	// Resumable uploads
+	filesWrite.HandleFunc("/uploads/{id}", filescontroller.UploadStatus).Methods("HEAD")
+	filesWrite.HandleFunc("/uploads/{id}", filescontroller.UploadChunk).Methods("PATCH")
+	filesWrite.HandleFunc("/uploads/{id}", filescontroller.CancelUpload).Methods("DELETE")
+	filesWrite.HandleFunc("/uploads/{id}/finalize", filescontroller.FinalizeUpload).Methods("POST")
+
+	// ValidatorHandler - Create upload
+	uploadsCreateValidator := filesWrite.NewRoute().Subrouter()
+	uploadsCreateValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(filesstruct.CreateUpload{})))
+	uploadsCreateValidator.HandleFunc("/uploads", filescontroller.CreateUpload).Methods("POST")
+
+	// ValidatorHandler - Signed links, sharing a file only needs to be able to read it
+	signedLinkValidator := filesRead.NewRoute().Subrouter()
+	signedLinkValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(filesstruct.CreateSignedLink{})))
+	signedLinkValidator.HandleFunc("/{filename}/link", filescontroller.CreateSignedLink).Methods("POST")
 }
@@ -0,0 +1,250 @@
+package fileservice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+
+	// Every allowed image type needs its decoder for the thumbnails
+	_ "image/gif"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+)
+
+const ThumbnailMaxSize = 256
+
+// Larger images are not decoded, a small file can declare a huge canvas
+const MaxThumbnailPixels = 40_000_000
+
+var ErrImageTooLarge = errors.New("image too large to process")
+
+// StripMetadata removes EXIF, XMP and text metadata from JPEG, PNG and WebP files.
+// Any other format, or a file that can not be parsed, is returned untouched.
+func StripMetadata(data []byte, mime string) []byte {
+	switch mime {
+	case "image/jpeg":
+		if cleaned, ok := stripJPEG(data); ok {
+			return cleaned
+		}
+	case "image/png":
+		if cleaned, ok := stripPNG(data); ok {
+			return cleaned
+		}
+	case "image/webp":
+		if cleaned, ok := stripWebP(data); ok {
+			return cleaned
+		}
+	}
+	return data
+}
+
+// Walk the JPEG segments and drop APP1 (EXIF/XMP) and APP13 (IPTC)
+func stripJPEG(data []byte) ([]byte, bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, false
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	i := 2
+	for i < len(data) {
+		if data[i] != 0xFF || i+1 >= len(data) {
+			return nil, false
+		}
+		marker := data[i+1]
+
+		// Standalone markers do not carry a length
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0xFF {
+			out.WriteByte(data[i])
+			if marker != 0xFF {
+				out.WriteByte(marker)
+				i += 2
+			} else {
+				i++
+			}
+			continue
+		}
+
+		// After the start of scan the rest is image data
+		if marker == 0xDA || marker == 0xD9 {
+			out.Write(data[i:])
+			return out.Bytes(), true
+		}
+
+		if i+4 > len(data) {
+			return nil, false
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, false
+		}
+
+		if marker != 0xE1 && marker != 0xED {
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+
+	return out.Bytes(), true
+}
+
+// Walk the PNG chunks and drop the ones that can carry metadata
+func stripPNG(data []byte) ([]byte, bool) {
+	signature := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}
+	if !bytes.HasPrefix(data, signature) {
+		return nil, false
+	}
+
+	removed := map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(signature)
+
+	i := len(signature)
+	for i < len(data) {
+		if i+8 > len(data) {
+			return nil, false
+		}
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		chunkType := string(data[i+4 : i+8])
+		end := i + 12 + length // length + type + data + crc
+		if length < 0 || end > len(data) {
+			return nil, false
+		}
+
+		if !removed[chunkType] {
+			out.Write(data[i:end])
+		}
+		i = end
+
+		if chunkType == "IEND" {
+			break
+		}
+	}
+
+	return out.Bytes(), true
+}
+
+// Walk the RIFF chunks of a WebP and drop EXIF and XMP, the flags of VP8X announce them too
+func stripWebP(data []byte) ([]byte, bool) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, false
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	i := 12
+	for i < len(data) {
+		if i+8 > len(data) {
+			return nil, false
+		}
+		chunkType := string(data[i : i+4])
+		length := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+		end := i + 8 + length + length%2 // chunks are padded to an even size
+		if length < 0 || end > len(data) {
+			return nil, false
+		}
+
+		switch chunkType {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte{}, data[i:end]...)
+			if length > 0 {
+				chunk[8] &^= 0x08 | 0x04 // EXIF and XMP flags
+			}
+			out.Write(chunk)
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+
+	cleaned := out.Bytes()
+	binary.LittleEndian.PutUint32(cleaned[4:8], uint32(len(cleaned)-8))
+	return cleaned, true
+}
+
+// CreateThumbnail decodes the image and writes a JPEG that fits in ThumbnailMaxSize
+func CreateThumbnail(data []byte, dstPath string) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if int64(config.Width)*int64(config.Height) > MaxThumbnailPixels {
+		return ErrImageTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	thumb := resize(src, ThumbnailMaxSize)
+
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	return jpeg.Encode(dst, thumb, &jpeg.Options{Quality: 80})
+}
+
+// Box filter resize, keeps the aspect ratio and never upscales
+func resize(src image.Image, maxSize int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	dstW, dstH := srcW, srcH
+	if srcW > maxSize || srcH > maxSize {
+		if srcW >= srcH {
+			dstW = maxSize
+			dstH = max(1, srcH*maxSize/srcW)
+		} else {
+			dstH = maxSize
+			dstW = max(1, srcW*maxSize/srcH)
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0 := bounds.Min.Y + y*srcH/dstH
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcH/dstH)
+		for x := 0; x < dstW; x++ {
+			x0 := bounds.Min.X + x*srcW/dstW
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcW/dstW)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					b += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+
+			// Colors are premultiplied, flatten transparency over white for JPEG
+			white := 0xffff - a/n
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r/n + white),
+				G: uint16(g/n + white),
+				B: uint16(b/n + white),
+				A: 0xffff,
+			})
+		}
+	}
+
+	return dst
+}
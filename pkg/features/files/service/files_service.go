@@ -1,21 +1,70 @@
 package fileservice
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	"github.com/Gamequic/LivePreviewBackend/pkg/scope"
 	"github.com/Gamequic/LivePreviewBackend/utils"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
 var Logger *zap.Logger
 
 const UploadsPath = "./uploads"
+const ThumbnailsPath = "./uploads/thumbnails"
+
+// Only images and PDFs can be uploaded, the content is sniffed, the extension is ignored
+var AllowedMimeTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"image/bmp",
+	"application/pdf",
+}
+
+// Photos are processed in memory, the resumable uploads of bigger ones are refused
+const MaxProcessedImageSize int64 = 100 << 20 // 100MB
+
+var (
+	ErrMimeTypeNotAllowed = errors.New("file type not allowed")
+	ErrPieceNotFound      = errors.New("piece not found")
+)
+
+type Files struct {
+	gorm.Model
+	OriginalName string `gorm:"not null" json:"OriginalName"`
+	StoredName   string `gorm:"unique;not null" json:"StoredName"`
+	MimeType     string `gorm:"not null" json:"MimeType"`
+	Size         int64  `gorm:"not null" json:"Size"`
+	HasThumbnail bool   `gorm:"default:false" json:"HasThumbnail"`
+	UploadedBy   int    `json:"UploadedBy"`
+	PieceID      *uint  `gorm:"index" json:"PieceId,omitempty"` // the piece gives access to its hospital and doctor
+}
 
 // Initialize the auth service
 func InitAuthService() {
 	Logger = utils.NewLogger()
+
+	// Without it anyone could sign links, the API does not start
+	signingSecret = []byte(os.Getenv("FILES_SIGNING_SECRET"))
+	if len(signingSecret) == 0 {
+		panic(errors.New("FILES_SIGNING_SECRET is required"))
+	}
+
+	err := database.DB.AutoMigrate(&Files{}, &FileUploads{})
+	if err != nil {
+		Logger.Error(fmt.Sprint("Failed to migrate database:", err))
+	}
 }
 
 // CreateUploadsFolder ensures the uploads folder exists
@@ -29,6 +78,13 @@ func CreateUploadsFolder() {
 	} else {
 		Logger.Info("📂 Uploads folder already exists")
 	}
+
+	if err := os.MkdirAll(ThumbnailsPath, 0755); err != nil {
+		Logger.Error(fmt.Sprintf("❌ Error creating thumbnails folder: %v", err))
+	}
+	if err := os.MkdirAll(PartialUploadsPath, 0755); err != nil {
+		Logger.Error(fmt.Sprintf("❌ Error creating partial uploads folder: %v", err))
+	}
 }
 
 // GetFilePath returns the full path for a given filename, ensuring it's safe
@@ -41,3 +97,165 @@ func GetFilePath(filename string) (string, error) {
 	}
 	return fullPath, nil
 }
+
+// scopeFiles restricts a query of files to the ones the user uploaded and the ones of the
+// pieces of their hospitals and doctors, the lab staff reach every file
+func scopeFiles(query *gorm.DB, sc scope.Scope) *gorm.DB {
+	if sc.Global {
+		return query
+	}
+	pieces := sc.Apply(database.DB.Table("pieces").Select("id").Where("deleted_at IS NULL"), "hospital_id", "doctor_id")
+	return query.Where("(uploaded_by = ? OR piece_id IN (?))", sc.UserID, pieces)
+}
+
+// CheckPiece fails when the piece does not exist or is outside the scope, a file is only
+// attached to a piece the user can see
+func CheckPiece(pieceId uint, sc scope.Scope) error {
+	var count int64
+	query := database.DB.Table("pieces").Where("id = ? AND deleted_at IS NULL", pieceId)
+	if err := sc.Apply(query, "hospital_id", "doctor_id").Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrPieceNotFound
+	}
+	return nil
+}
+
+// CanAccessFile tells if the file is inside the scope
+func CanAccessFile(filename string, sc scope.Scope) bool {
+	var count int64
+	scopeFiles(database.DB.Model(&Files{}), sc).
+		Where("stored_name = ?", filepath.Base(filename)).
+		Count(&count)
+	return count > 0
+}
+
+// GetThumbnailPath returns the thumbnail of the file with the given id
+func GetThumbnailPath(id uint, sc scope.Scope) (string, error) {
+	query := scopeFiles(database.DB, sc)
+
+	var file Files
+	if err := query.First(&file, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", os.ErrNotExist
+		}
+		return "", err
+	}
+
+	if !file.HasThumbnail {
+		return "", os.ErrNotExist
+	}
+
+	fullPath := filepath.Join(ThumbnailsPath, thumbnailName(file.StoredName))
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		return "", os.ErrNotExist
+	}
+	return fullPath, nil
+}
+
+// SaveFile sniffs the content, strips metadata from photos, stores the file and
+// generates the thumbnail when the format allows it
+func SaveFile(data []byte, originalName string, userId int, pieceId *uint) (*Files, error) {
+	mtype := mimetype.Detect(data)
+	if !mimetype.EqualsAny(mtype.String(), AllowedMimeTypes...) {
+		Logger.Info("Rejected upload", zap.String("file", originalName), zap.String("mime", mtype.String()))
+		return nil, ErrMimeTypeNotAllowed
+	}
+
+	// Remove EXIF, GPS and other metadata before it touches the disk
+	data = StripMetadata(data, mtype.String())
+
+	file := newFileRecord(mtype, originalName, int64(len(data)), userId, pieceId)
+	fullPath := filepath.Join(UploadsPath, file.StoredName)
+	if err := os.WriteFile(fullPath, data, 0644); err != nil {
+		Logger.Error("Error writing file", zap.Error(err))
+		return nil, err
+	}
+
+	if strings.HasPrefix(file.MimeType, "image/") {
+		thumbPath := filepath.Join(ThumbnailsPath, thumbnailName(file.StoredName))
+		if err := CreateThumbnail(data, thumbPath); err != nil {
+			// Not every image format can be decoded, the file is still valid
+			Logger.Info("Thumbnail not generated", zap.String("file", file.StoredName), zap.Error(err))
+		} else {
+			file.HasThumbnail = true
+		}
+	}
+
+	if err := saveFileRecord(file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// SaveFileFromPath stores a file that is already on disk. Formats that are processed
+// go through SaveFile, everything else is moved without loading it in memory.
+func SaveFileFromPath(srcPath string, originalName string, userId int, pieceId *uint) (*Files, error) {
+	mtype, err := mimetype.DetectFile(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	if !mimetype.EqualsAny(mtype.String(), AllowedMimeTypes...) {
+		Logger.Info("Rejected upload", zap.String("file", originalName), zap.String("mime", mtype.String()))
+		return nil, ErrMimeTypeNotAllowed
+	}
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if mimetype.EqualsAny(mtype.String(), "image/jpeg", "image/png", "image/gif", "image/webp") {
+		// The metadata has to be removed, a photo this big is refused instead of loaded
+		if info.Size() > MaxProcessedImageSize {
+			Logger.Info("Rejected upload", zap.String("file", originalName), zap.Int64("size", info.Size()))
+			return nil, ErrImageTooLarge
+		}
+		data, err := os.ReadFile(srcPath)
+		if err != nil {
+			return nil, err
+		}
+		file, err := SaveFile(data, originalName, userId, pieceId)
+		if err == nil {
+			os.Remove(srcPath)
+		}
+		return file, err
+	}
+
+	file := newFileRecord(mtype, originalName, info.Size(), userId, pieceId)
+	if err := os.Rename(srcPath, filepath.Join(UploadsPath, file.StoredName)); err != nil {
+		Logger.Error("Error moving file", zap.Error(err))
+		return nil, err
+	}
+
+	if err := saveFileRecord(file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func newFileRecord(mtype *mimetype.MIME, originalName string, size int64, userId int, pieceId *uint) *Files {
+	return &Files{
+		OriginalName: filepath.Base(originalName),
+		StoredName:   uuid.New().String() + mtype.Extension(),
+		MimeType:     mtype.String(),
+		Size:         size,
+		UploadedBy:   userId,
+		PieceID:      pieceId,
+	}
+}
+
+// Save the record, if it fails the stored file is removed so nothing is orphaned
+func saveFileRecord(file *Files) error {
+	if err := database.DB.Create(file).Error; err != nil {
+		os.Remove(filepath.Join(UploadsPath, file.StoredName))
+		os.Remove(filepath.Join(ThumbnailsPath, thumbnailName(file.StoredName)))
+		return err
+	}
+	return nil
+}
+
+func thumbnailName(storedName string) string {
+	return strings.TrimSuffix(storedName, filepath.Ext(storedName)) + ".jpg"
+}
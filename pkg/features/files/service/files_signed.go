@@ -0,0 +1,126 @@
+package fileservice
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+)
+
+const DefaultSignedLinkExpiration = time.Hour
+const MaxSignedLinkExpiration = 7 * 24 * time.Hour
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrLinkExpired      = errors.New("link expired")
+	ErrLinkAlreadyUsed  = errors.New("link already used")
+)
+
+type SignedLink struct {
+	Url       string    `json:"Url"`
+	ExpiresAt time.Time `json:"ExpiresAt"`
+	SingleUse bool      `json:"SingleUse"`
+}
+
+// The links have their own secret so they can be rotated without closing the sessions,
+// read once by InitAuthService
+var signingSecret []byte
+
+func signingKey() []byte {
+	return signingSecret
+}
+
+func sign(filename string, expires int64, nonce string) string {
+	mac := hmac.New(sha256.New, signingKey())
+	mac.Write([]byte(fmt.Sprintf("%s|%d|%s", filename, expires, nonce)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CreateSignedLink returns a link to the file that works without the Authorization header
+func CreateSignedLink(filename string, expiresIn time.Duration, singleUse bool) (*SignedLink, error) {
+	if _, err := GetFilePath(filename); err != nil {
+		return nil, err
+	}
+	cleanName := filepath.Base(filename)
+
+	if expiresIn <= 0 {
+		expiresIn = DefaultSignedLinkExpiration
+	}
+	if expiresIn > MaxSignedLinkExpiration {
+		expiresIn = MaxSignedLinkExpiration
+	}
+	expiresAt := time.Now().Add(expiresIn)
+
+	// Single use links carry a nonce that is burned on the first download
+	nonce := ""
+	if singleUse {
+		bytes := make([]byte, 16)
+		if _, err := rand.Read(bytes); err != nil {
+			return nil, err
+		}
+		nonce = hex.EncodeToString(bytes)
+	}
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expiresAt.Unix(), 10))
+	if nonce != "" {
+		query.Set("nonce", nonce)
+	}
+	query.Set("signature", sign(cleanName, expiresAt.Unix(), nonce))
+
+	link := fmt.Sprintf("%s/api/files/signed/%s?%s", os.Getenv("PUBLIC_API_URL"), url.PathEscape(cleanName), query.Encode())
+
+	return &SignedLink{
+		Url:       link,
+		ExpiresAt: expiresAt,
+		SingleUse: singleUse,
+	}, nil
+}
+
+// VerifySignedLink checks the signature and the expiration, and burns single use links
+func VerifySignedLink(filename string, expires string, nonce string, signature string) (string, error) {
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+
+	expected := sign(filename, expiresUnix, nonce)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", ErrInvalidSignature
+	}
+
+	expiresAt := time.Unix(expiresUnix, 0)
+	if time.Now().After(expiresAt) {
+		return "", ErrLinkExpired
+	}
+
+	fullPath, err := GetFilePath(filename)
+	if err != nil {
+		return "", err
+	}
+
+	if nonce != "" {
+		// Keep the nonce until the link expires, after that the signature check rejects it anyway
+		ctx := context.Background()
+		firstUse, err := database.RedisClient.SetNX(ctx, "signed_file_nonce:"+nonce, filename, time.Until(expiresAt)).Result()
+		if err != nil {
+			return "", err
+		}
+		if !firstUse {
+			return "", ErrLinkAlreadyUsed
+		}
+	}
+
+	return fullPath, nil
+}
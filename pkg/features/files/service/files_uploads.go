@@ -0,0 +1,294 @@
+package fileservice
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const PartialUploadsPath = "./uploads/partial"
+
+// Resumable uploads are meant for slide scans, the single request upload keeps its 10MB limit
+const MaxResumableUploadSize int64 = 4 << 30 // 4GB
+
+// Unfinished uploads are removed after this time without activity
+const UploadExpiration = 24 * time.Hour
+
+var (
+	ErrUploadNotFound   = errors.New("upload not found")
+	ErrUploadTooBig     = errors.New("upload exceeds the maximum size")
+	ErrOffsetMismatch   = errors.New("upload offset does not match")
+	ErrUploadIncomplete = errors.New("upload is not complete")
+	ErrChecksumMismatch = errors.New("checksum does not match")
+)
+
+// State of a resumable upload, it lives in the database so clients can resume after a reconnect
+type FileUploads struct {
+	ID         string    `gorm:"primaryKey" json:"ID"`
+	Filename   string    `gorm:"not null" json:"Filename"`
+	Size       int64     `gorm:"not null" json:"Size"`
+	Offset     int64     `gorm:"not null;default:0" json:"Offset"`
+	Checksum   string    `gorm:"not null" json:"Checksum"`
+	UploadedBy int       `gorm:"not null" json:"UploadedBy"`
+	PieceID    *uint     `json:"PieceId,omitempty"`
+	ExpiresAt  time.Time `gorm:"not null" json:"ExpiresAt"`
+	CreatedAt  time.Time `json:"CreatedAt"`
+	UpdatedAt  time.Time `json:"UpdatedAt"`
+}
+
+// Only one chunk at a time can be written on the same upload. The lock of an upload is
+// dropped once nobody holds or waits for it, never before
+type uploadLock struct {
+	sync.Mutex
+	users int // holders and waiters, guarded by uploadLocksMu
+}
+
+var (
+	uploadLocksMu sync.Mutex
+	uploadLocks   = map[string]*uploadLock{}
+)
+
+func lockUpload(id string) func() {
+	uploadLocksMu.Lock()
+	lock, found := uploadLocks[id]
+	if !found {
+		lock = &uploadLock{}
+		uploadLocks[id] = lock
+	}
+	lock.users++
+	uploadLocksMu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		uploadLocksMu.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(uploadLocks, id)
+		}
+		uploadLocksMu.Unlock()
+	}
+}
+
+func partialPath(id string) string {
+	return filepath.Join(PartialUploadsPath, filepath.Base(id)+".part")
+}
+
+// CreateUpload registers a new resumable upload and creates its empty part file
+func CreateUpload(filename string, size int64, checksum string, userId int, pieceId *uint) (*FileUploads, error) {
+	if size > MaxResumableUploadSize {
+		return nil, ErrUploadTooBig
+	}
+
+	upload := &FileUploads{
+		ID:         uuid.New().String(),
+		Filename:   filepath.Base(filename),
+		Size:       size,
+		Checksum:   strings.ToLower(checksum),
+		UploadedBy: userId,
+		PieceID:    pieceId,
+		ExpiresAt:  time.Now().Add(UploadExpiration),
+	}
+
+	part, err := os.Create(partialPath(upload.ID))
+	if err != nil {
+		Logger.Error("Error creating part file", zap.Error(err))
+		return nil, err
+	}
+	part.Close()
+
+	if err := database.DB.Create(upload).Error; err != nil {
+		os.Remove(partialPath(upload.ID))
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+// GetUpload returns the upload only if it belongs to the user
+func GetUpload(id string, userId int) (*FileUploads, error) {
+	var upload FileUploads
+	if err := database.DB.Where("id = ? AND uploaded_by = ?", id, userId).First(&upload).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+
+	if time.Now().After(upload.ExpiresAt) {
+		return nil, ErrUploadNotFound
+	}
+
+	return &upload, nil
+}
+
+// WriteChunk appends the chunk at the given offset. If the connection drops in the
+// middle of the chunk the bytes that arrived are kept, so HEAD reports the real progress.
+func WriteChunk(id string, userId int, offset int64, chunk io.Reader) (*FileUploads, error) {
+	unlock := lockUpload(id)
+	defer unlock()
+
+	upload, err := GetUpload(id, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset != upload.Offset {
+		return upload, ErrOffsetMismatch
+	}
+
+	part, err := os.OpenFile(partialPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer part.Close()
+
+	// Anything after the saved offset is garbage from an interrupted request
+	if err := part.Truncate(upload.Offset); err != nil {
+		return nil, err
+	}
+	if _, err := part.Seek(upload.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	written, copyErr := io.Copy(part, io.LimitReader(chunk, upload.Size-upload.Offset))
+
+	upload.Offset += written
+	upload.ExpiresAt = time.Now().Add(UploadExpiration)
+	if err := database.DB.Model(upload).Updates(map[string]interface{}{
+		"offset":     upload.Offset,
+		"expires_at": upload.ExpiresAt,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	if copyErr != nil {
+		Logger.Info(fmt.Sprintf("Chunk interrupted on upload %s at offset %d", id, upload.Offset), zap.Error(copyErr))
+		return upload, copyErr
+	}
+
+	return upload, nil
+}
+
+// FinalizeUpload verifies the checksum and moves the assembled file to the uploads folder
+func FinalizeUpload(id string, userId int) (*Files, error) {
+	unlock := lockUpload(id)
+	defer unlock()
+
+	upload, err := GetUpload(id, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if upload.Offset != upload.Size {
+		return nil, ErrUploadIncomplete
+	}
+
+	part, err := os.Open(partialPath(id))
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, part)
+	part.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != upload.Checksum {
+		// The client has to start over, the bytes on disk are not the ones it sent
+		discardUpload(upload)
+		return nil, ErrChecksumMismatch
+	}
+
+	file, err := SaveFileFromPath(partialPath(id), upload.Filename, userId, upload.PieceID)
+	if err != nil {
+		if errors.Is(err, ErrMimeTypeNotAllowed) || errors.Is(err, ErrImageTooLarge) {
+			discardUpload(upload)
+		}
+		return nil, err
+	}
+
+	database.DB.Delete(upload)
+
+	return file, nil
+}
+
+// CancelUpload removes an unfinished upload
+func CancelUpload(id string, userId int) error {
+	unlock := lockUpload(id)
+	defer unlock()
+
+	upload, err := GetUpload(id, userId)
+	if err != nil {
+		return err
+	}
+
+	discardUpload(upload)
+	return nil
+}
+
+func discardUpload(upload *FileUploads) {
+	os.Remove(partialPath(upload.ID))
+	database.DB.Delete(upload)
+}
+
+// CleanExpiredUploads removes the uploads that were abandoned
+func CleanExpiredUploads() {
+	var expired []FileUploads
+	if err := database.DB.Where("expires_at < ?", time.Now()).Find(&expired).Error; err != nil {
+		Logger.Error("Error retrieving expired uploads", zap.Error(err))
+		return
+	}
+
+	removed := 0
+	for i := range expired {
+		if discardExpiredUpload(expired[i].ID) {
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		Logger.Info(fmt.Sprintf("Removed %d expired uploads", removed))
+	}
+}
+
+// discardExpiredUpload removes the upload under its lock, a chunk written since it was found
+// extends it and keeps it
+func discardExpiredUpload(id string) bool {
+	unlock := lockUpload(id)
+	defer unlock()
+
+	var upload FileUploads
+	if err := database.DB.Where("id = ? AND expires_at < ?", id, time.Now()).First(&upload).Error; err != nil {
+		return false
+	}
+	discardUpload(&upload)
+	return true
+}
+
+// StartUploadsJanitor cleans the expired uploads every hour
+func StartUploadsJanitor() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			CleanExpiredUploads()
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,13 @@
+package filesstruct
+
+type CreateUpload struct {
+	Filename string `validate:"required" json:"Filename"`
+	Size     int64  `validate:"required,gt=0" json:"Size"`
+	Checksum string `validate:"required,len=64,hexadecimal" json:"Checksum"` // sha256 of the whole file
+	PieceId  uint   `validate:"omitempty,min=1" json:"PieceId"`              // optional, the piece the file belongs to
+}
+
+type CreateSignedLink struct {
+	ExpiresIn int  `validate:"omitempty,min=1,max=604800" json:"ExpiresIn"` // seconds, one hour by default
+	SingleUse bool `json:"SingleUse"`
+}
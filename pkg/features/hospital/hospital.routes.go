@@ -5,6 +5,8 @@ import (
 	"net/http"
 
 	hospitalservice "github.com/Gamequic/LivePreviewBackend/pkg/features/hospital/service"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 
 	"github.com/gorilla/mux"
 )
@@ -30,7 +32,7 @@ import (
 func find(w http.ResponseWriter, r *http.Request) {
 	//Service
 	var hospitals []hospitalservice.Hospital
-	var httpsResponse int = hospitalservice.Find(&hospitals)
+	var httpsResponse int = hospitalservice.Find(&hospitals, middlewares.UserScope(r))
 
 	//Https response
 	w.WriteHeader(httpsResponse)
@@ -81,7 +83,7 @@ func find(w http.ResponseWriter, r *http.Request) {
 
 func RegisterSubRoutes(router *mux.Router) {
 	piecesRouter := router.PathPrefix("/hospital").Subrouter()
-	// piecesRouter.Use(middlewares.AuthHandler)
+	piecesRouter.Use(middlewares.AuthHandler)
 
 	// ValidatorHandler - Update
 	// usersUpdateValidator := piecesRouter.NewRoute().Subrouter()
@@ -96,7 +98,7 @@ func RegisterSubRoutes(router *mux.Router) {
 
 	// Protected functions
 	piecesProtected := piecesRouter.NewRoute().Subrouter()
-	// piecesProtected.Use(middlewares.ProfilesHandler([]uint{1, 2, 4}))
+	piecesProtected.Use(middlewares.RequirePermission(permissions.HospitalsRead))
 	piecesProtected.HandleFunc("/", find).Methods("GET")
 	// piecesProtected.HandleFunc("/{id}", findOne).Methods("GET")
 	// piecesProtected.HandleFunc("/{id}", delete).Methods("DELETE")
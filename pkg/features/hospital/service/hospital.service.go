@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	"github.com/Gamequic/LivePreviewBackend/pkg/scope"
 	"github.com/Gamequic/LivePreviewBackend/utils"
 	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 
@@ -48,8 +49,17 @@ func InitHospitalService() {
 // 	return http.StatusOK
 // }
 
-func Find(Hospitals *[]Hospital) int {
-	if err := database.DB.Find(Hospitals).Error; err != nil {
+// Find returns the hospitals of the scope, a doctor sees the hospitals where they work
+func Find(Hospitals *[]Hospital, sc scope.Scope) int {
+	query := database.DB
+	if !sc.Global {
+		query = query.Where(
+			"id IN ? OR id IN (SELECT hospital_id FROM doctor_hospitals WHERE doctor_id IN ?)",
+			sc.HospitalIDsOrNone(), sc.DoctorIDsOrNone(),
+		)
+	}
+
+	if err := query.Find(Hospitals).Error; err != nil {
 		panic(middlewares.GormError{
 			Code:    http.StatusInternalServerError,
 			Message: "Error retrieving pieces",
@@ -2,12 +2,20 @@ package logs
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	logsservice "github.com/Gamequic/LivePreviewBackend/pkg/features/logsViewer/service"
+	logsstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/logsViewer/struct"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
+	"github.com/Gamequic/LivePreviewBackend/pkg/session"
 	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 // Obtener estructura de logs
@@ -63,13 +71,114 @@ func downloadLogs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Buscar en los logs
+func searchLogs(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+
+	today := time.Now().Format("2006-01-02")
+	from, errFrom := time.ParseInLocation("2006-01-02", valueOr(values.Get("from"), today), time.Local)
+	to, errTo := time.ParseInLocation("2006-01-02", valueOr(values.Get("to"), valueOr(values.Get("from"), today)), time.Local)
+	if errFrom != nil || errTo != nil {
+		http.Error(w, "Dates must be in the format YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if to.Before(from) || to.Sub(from) > logsservice.MaxSearchDays*24*time.Hour {
+		http.Error(w, fmt.Sprintf("The range must go forward and be at most %d days", logsservice.MaxSearchDays), http.StatusBadRequest)
+		return
+	}
+
+	page, errPage := strconv.Atoi(valueOr(values.Get("page"), "1"))
+	limit, errLimit := strconv.Atoi(valueOr(values.Get("limit"), "100"))
+	if errPage != nil || errLimit != nil || page < 1 || limit < 1 {
+		http.Error(w, "page and limit must be positive numbers", http.StatusBadRequest)
+		return
+	}
+	if limit > 500 {
+		limit = 500
+	}
+
+	query := filtersFrom(values)
+	query.From = from
+	query.To = to
+	query.Page = page
+	query.Limit = limit
+	query.Oldest = values.Get("order") == "asc"
+
+	result, err := logsservice.Search(query)
+	if err != nil {
+		http.Error(w, "Error reading logs: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// filtersFrom reads the filters shared by the search and the tail
+func filtersFrom(values url.Values) logsstruct.LogSearchQuery {
+	query := logsstruct.LogSearchQuery{
+		Text:   values.Get("q"),
+		Caller: values.Get("caller"),
+		Fields: map[string]string{},
+	}
+	if levels := values.Get("level"); levels != "" {
+		query.Levels = strings.Split(levels, ",")
+	}
+	if requestId := values.Get("request_id"); requestId != "" {
+		query.Fields["request_id"] = requestId
+	}
+	// Any other field of the entries, field.user=5
+	for key := range values {
+		if name, found := strings.CutPrefix(key, "field."); found && name != "" {
+			query.Fields[name] = values.Get(key)
+		}
+	}
+	return query
+}
+
+// Live tail of the logs, the token comes like on the notifications socket
+func tailLogs(w http.ResponseWriter, r *http.Request) {
+	query := filtersFrom(r.URL.Query())
+
+	conn, claims := middlewares.UpgradeAuthenticated(w, r, 5*time.Second)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	// Same permission as the rest of the log routes
+	if !permissions.Has(claims.Profiles, permissions.LogsRead) {
+		middlewares.CloseWebSocket(conn, websocket.ClosePolicyViolation, "Access denied, missing permission "+permissions.LogsRead)
+		return
+	}
+
+	// Close the socket if the session is revoked
+	untrack := session.TrackConnection(claims.Id, claims.SessionID, func() { conn.Close() })
+	defer untrack()
+
+	logsservice.Tail(conn, query)
+}
+
+func valueOr(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
 // Registrar rutas
 func RegisterSubRoutes(router *mux.Router) {
 	logsRouter := router.PathPrefix("/logs").Subrouter()
-	logsRouter.Use(middlewares.AuthHandler)
-	logsRouter.Use(middlewares.ProfilesHandler([]uint{1, 2, 5}))
 
-	logsRouter.HandleFunc("/structure", getLogsStructure).Methods("GET")
-	logsRouter.HandleFunc("/view/{date}", getLogFile).Methods("GET")
-	logsRouter.HandleFunc("/download", downloadLogs).Methods("GET")
+	// Websocket, it authenticates itself
+	logsRouter.HandleFunc("/tail", tailLogs).Methods("GET")
+
+	logsProtected := logsRouter.NewRoute().Subrouter()
+	logsProtected.Use(middlewares.AuthHandler)
+	logsProtected.Use(middlewares.RequirePermission(permissions.LogsRead))
+
+	logsProtected.HandleFunc("/structure", getLogsStructure).Methods("GET")
+	logsProtected.HandleFunc("/view/{date}", getLogFile).Methods("GET")
+	logsProtected.HandleFunc("/download", downloadLogs).Methods("GET")
+	logsProtected.HandleFunc("/search", searchLogs).Methods("GET")
 }
@@ -0,0 +1,254 @@
+package logsservice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	logsstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/logsViewer/struct"
+	"github.com/Gamequic/LivePreviewBackend/utils"
+)
+
+/*
+	Search on the log files. utils.NewLogger writes one JSON object per line, so the files are
+	read line by line, never whole, and the search stops as soon as the page is full.
+	The newest first order reads every file from its end. The live tail uses the same filters.
+*/
+
+const (
+	MaxSearchDays = 92
+	readChunk     = 64 * 1024
+)
+
+// Keys every entry has, the rest go to Fields
+var entryKeys = map[string]bool{"time": true, "level": true, "msg": true, "caller": true, "stacktrace": true}
+
+// Search returns the page of the entries that match the query
+func Search(query logsstruct.LogSearchQuery) (logsstruct.LogSearchResult, error) {
+	result := logsstruct.LogSearchResult{Entries: []logsstruct.LogEntry{}, Page: query.Page, Limit: query.Limit}
+
+	match := matcher(query)
+	skip := (query.Page - 1) * query.Limit
+	days := searchDays(query.From, query.To, query.Oldest)
+
+	for _, day := range days {
+		date := day.Format("2006-01-02")
+		file, err := os.Open(logFilePath(date))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return result, err
+		}
+
+		// Returns false once the page is full and one more entry proves there is a next page
+		visit := func(line []byte) bool {
+			entry, ok := match(line, date)
+			if !ok {
+				return true
+			}
+
+			if skip > 0 {
+				skip--
+				return true
+			}
+			if len(result.Entries) == query.Limit {
+				result.HasMore = true
+				return false
+			}
+			result.Entries = append(result.Entries, entry)
+			return true
+		}
+
+		if query.Oldest {
+			err = eachLine(file, visit)
+		} else {
+			err = eachLineReverse(file, visit)
+		}
+		file.Close()
+		if err != nil {
+			return result, err
+		}
+		if result.HasMore {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// searchDays are the days of the range in the order they are read
+func searchDays(from time.Time, to time.Time, oldest bool) []time.Time {
+	days := []time.Time{}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+	if !oldest {
+		for i, j := 0, len(days)-1; i < j; i, j = i+1, j-1 {
+			days[i], days[j] = days[j], days[i]
+		}
+	}
+	return days
+}
+
+// matcher parses the lines that pass the filters of the query, shared by the search and the tail
+func matcher(query logsstruct.LogSearchQuery) func(line []byte, date string) (logsstruct.LogEntry, bool) {
+	levels := map[string]bool{}
+	for _, level := range query.Levels {
+		levels[strings.ToUpper(strings.TrimSpace(level))] = true
+	}
+	text := strings.ToLower(query.Text)
+
+	return func(line []byte, date string) (logsstruct.LogEntry, bool) {
+		// Cheap check before parsing, zap always writes the level the same way
+		if len(levels) > 0 && !hasLevel(line, levels) {
+			return logsstruct.LogEntry{}, false
+		}
+
+		entry, ok := parseEntry(line, date)
+		if !ok || !matches(&entry, levels, text, query) {
+			return logsstruct.LogEntry{}, false
+		}
+		return entry, true
+	}
+}
+
+func hasLevel(line []byte, levels map[string]bool) bool {
+	for level := range levels {
+		if bytes.Contains(line, []byte(`"level":"`+level+`"`)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseEntry reads a line of the file, false for the lines that are not JSON, like one being
+// written right now
+func parseEntry(line []byte, date string) (logsstruct.LogEntry, bool) {
+	var values map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber() // ids are compared as written
+	if err := decoder.Decode(&values); err != nil {
+		return logsstruct.LogEntry{}, false
+	}
+
+	entry := logsstruct.LogEntry{Date: date}
+	entry.Level, _ = values["level"].(string)
+	entry.Message, _ = values["msg"].(string)
+	entry.Caller, _ = values["caller"].(string)
+	entry.Stacktrace, _ = values["stacktrace"].(string)
+	if raw, ok := values["time"].(string); ok {
+		entry.Time, _ = time.ParseInLocation(utils.LogTimeLayout, raw, time.Local)
+	}
+
+	for key, value := range values {
+		if entryKeys[key] {
+			continue
+		}
+		if entry.Fields == nil {
+			entry.Fields = map[string]interface{}{}
+		}
+		entry.Fields[key] = value
+	}
+	return entry, true
+}
+
+func matches(entry *logsstruct.LogEntry, levels map[string]bool, text string, query logsstruct.LogSearchQuery) bool {
+	if len(levels) > 0 && !levels[entry.Level] {
+		return false
+	}
+	if text != "" && !strings.Contains(strings.ToLower(entry.Message), text) {
+		return false
+	}
+	if query.Caller != "" && !strings.Contains(entry.Caller, query.Caller) {
+		return false
+	}
+	for key, expected := range query.Fields {
+		value, found := entry.Fields[key]
+		if !found || fieldText(value) != expected {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldText is the value of a field as it is written on the query string
+func fieldText(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case nil:
+		return "null"
+	case bool, float64:
+		return fmt.Sprint(value)
+	default:
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	}
+}
+
+// eachLine calls visit with every line from the first one, until visit returns false
+func eachLine(file *os.File, visit func([]byte) bool) error {
+	reader := bufio.NewReaderSize(file, readChunk)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 && !visit(line) {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// eachLineReverse calls visit with every line from the last one, until visit returns false.
+// The file is read by chunks from its end
+func eachLineReverse(file *os.File, visit func([]byte) bool) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	offset := info.Size()
+	chunk := make([]byte, readChunk)
+	var rest []byte // start of the last line read, it began on an earlier chunk
+
+	for offset > 0 {
+		size := int64(readChunk)
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		if _, err := file.ReadAt(chunk[:size], offset); err != nil && err != io.EOF {
+			return err
+		}
+
+		data := append(append([]byte{}, chunk[:size]...), rest...)
+		for {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			if line := bytes.TrimSpace(data[i+1:]); len(line) > 0 && !visit(line) {
+				return nil
+			}
+			data = data[:i]
+		}
+		rest = data
+	}
+
+	if line := bytes.TrimSpace(rest); len(line) > 0 {
+		visit(line)
+	}
+	return nil
+}
@@ -51,11 +51,14 @@ func getFileType(fileName string) string {
 	}
 }
 
+// Path of the log file of a day, YYYY-MM-DD
+func logFilePath(date string) string {
+	return filepath.Join("./logs", date[:4], date[5:7], date+".log")
+}
+
 // Get the log file
 func GetLogFile(date string) (*os.File, error) {
-	logFilePath := filepath.Join("./logs", date[:4], date[5:7], date+".log")
-
-	file, err := os.Open(logFilePath)
+	file, err := os.Open(logFilePath(date))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, errors.New("Log file not found")
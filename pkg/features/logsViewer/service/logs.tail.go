@@ -0,0 +1,69 @@
+package logsservice
+
+import (
+	"time"
+
+	logsstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/logsViewer/struct"
+	"github.com/Gamequic/LivePreviewBackend/utils"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+	Live tail. The entries come from the loggers as they are written, they are filtered here
+	and sent to the socket. A slow client never holds the loggers: its buffer fills up, the
+	extra entries are dropped and the client is told how many it missed.
+*/
+
+const (
+	tailBuffer    = 1000 // entries waiting for a slow client
+	tailWriteWait = 10 * time.Second
+)
+
+// Tail sends the entries that match the query until the client leaves
+func Tail(conn *websocket.Conn, query logsstruct.LogSearchQuery) {
+	listener, stop := utils.ListenLogs(tailBuffer)
+	defer stop()
+
+	match := matcher(query)
+
+	write := func(message logsstruct.LogTailMessage) bool {
+		conn.SetWriteDeadline(time.Now().Add(tailWriteWait))
+		return conn.WriteJSON(message) == nil
+	}
+	// reportDropped tells the client about the entries lost since the last report
+	reportDropped := func() bool {
+		if dropped := listener.Dropped(); dropped > 0 {
+			return write(logsstruct.LogTailMessage{Type: "dropped", Dropped: dropped})
+		}
+		return true
+	}
+
+	closed := middlewares.WatchWebSocket(conn)
+	ping := time.NewTicker(middlewares.WebSocketPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case line := <-listener.C:
+			entry, ok := match(line, time.Now().Format("2006-01-02"))
+			if ok && !write(logsstruct.LogTailMessage{Type: "entry", Entry: &entry}) {
+				return
+			}
+			// The lost entries came after everything that was waiting in the buffer
+			if len(listener.C) == 0 && !reportDropped() {
+				return
+			}
+		case <-ping.C:
+			if !reportDropped() {
+				return
+			}
+			if !middlewares.PingWebSocket(conn) {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package logsstruct
 
+import "time"
+
 // Nodo para representar la estructura de logs
 type TreeLogNode struct {
 	ID       string        `json:"id"`
@@ -7,3 +9,41 @@ type TreeLogNode struct {
 	FileType string        `json:"fileType"`
 	Children []TreeLogNode `json:"children,omitempty"`
 }
+
+// Filters of the log search, the empty ones match everything
+type LogSearchQuery struct {
+	From   time.Time
+	To     time.Time // last day included
+	Levels []string  // INFO, WARN, ERROR...
+	Text   string    // part of the message, without case
+	Caller string    // part of the caller
+	Fields map[string]string
+	Page   int
+	Limit  int
+	Oldest bool // oldest first, by default the newest come first
+}
+
+// Line of a log file already parsed
+type LogEntry struct {
+	Time       time.Time              `json:"time"`
+	Level      string                 `json:"level"`
+	Message    string                 `json:"msg"`
+	Caller     string                 `json:"caller,omitempty"`
+	Stacktrace string                 `json:"stacktrace,omitempty"`
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+	Date       string                 `json:"date"` // file of the entry, YYYY-MM-DD
+}
+
+type LogSearchResult struct {
+	Entries []LogEntry `json:"entries"`
+	Page    int        `json:"page"`
+	Limit   int        `json:"limit"`
+	HasMore bool       `json:"hasMore"`
+}
+
+// Message of the live tail, an entry or how many entries the client missed for being slow
+type LogTailMessage struct {
+	Type    string    `json:"type"` // entry or dropped
+	Entry   *LogEntry `json:"entry,omitempty"`
+	Dropped int64     `json:"dropped,omitempty"`
+}
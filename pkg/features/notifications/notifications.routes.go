@@ -8,6 +8,7 @@ import (
 
 	notificationservice "github.com/Gamequic/LivePreviewBackend/pkg/features/notifications/service"
 	notificatonstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/notifications/struct"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
 	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 
 	"github.com/gorilla/mux"
@@ -31,8 +32,18 @@ func create(w http.ResponseWriter, r *http.Request) {
 
 func find(w http.ResponseWriter, r *http.Request) {
 	//Service
+	// Own notifications unless another user is asked for explicitly
+	userId := 0
+	if value := r.URL.Query().Get("user_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil || id <= 0 {
+			panic(middlewares.GormError{Code: 400, Message: "Invalid user_id", IsGorm: true})
+		}
+		userId = id
+	}
+
 	var notifications []notificationservice.Notifications
-	var httpsResponse int = notificationservice.Find(&notifications)
+	var httpsResponse int = notificationservice.Find(&notifications, middlewares.UserScope(r), userId)
 
 	//Https response
 	w.WriteHeader(httpsResponse)
@@ -45,28 +56,319 @@ func MarkAsSeen(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		panic(middlewares.GormError{Code: 400, Message: err.Error(), IsGorm: true})
 	}
-	var httpsResponse int = notificationservice.MarkAsSeen(id)
+	var httpsResponse int = notificationservice.MarkAsSeen(id, middlewares.UserScope(r))
 	w.WriteHeader(httpsResponse)
 	json.NewEncoder(w).Encode("Notification marked as seen")
 }
 
+func broadcast(w http.ResponseWriter, r *http.Request) {
+	var body notificatonstruct.NotificationBroadcast
+	json.NewDecoder(r.Body).Decode(&body)
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	var sent notificationservice.NotificationBroadcasts = notificationservice.Broadcast(&body, userId, middlewares.UserScope(r))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sent)
+}
+
+func findBroadcasts(w http.ResponseWriter, r *http.Request) {
+	var broadcasts []notificationservice.NotificationBroadcasts
+	var httpsResponse int = notificationservice.FindBroadcasts(&broadcasts, middlewares.UserScope(r))
+	w.WriteHeader(httpsResponse)
+	json.NewEncoder(w).Encode(broadcasts)
+}
+
+// Rules, events turned into notifications
+
+func ruleId(r *http.Request) uint {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		panic(middlewares.GormError{Code: 400, Message: err.Error(), IsGorm: true})
+	}
+	return uint(id)
+}
+
+func findRules(w http.ResponseWriter, r *http.Request) {
+	var rules []notificationservice.NotificationRules
+	var httpsResponse int = notificationservice.FindRules(&rules)
+	w.WriteHeader(httpsResponse)
+	json.NewEncoder(w).Encode(rules)
+}
+
+func findEventTypes(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(notificationservice.EventTypes())
+}
+
+func createRule(w http.ResponseWriter, r *http.Request) {
+	var body notificatonstruct.NotificationRule
+	json.NewDecoder(r.Body).Decode(&body)
+
+	var rule notificationservice.NotificationRules
+	var httpsResponse int = notificationservice.CreateRule(&rule, &body)
+	w.WriteHeader(httpsResponse)
+	json.NewEncoder(w).Encode(rule)
+}
+
+func updateRule(w http.ResponseWriter, r *http.Request) {
+	var body notificatonstruct.NotificationRule
+	json.NewDecoder(r.Body).Decode(&body)
+
+	var rule notificationservice.NotificationRules
+	var httpsResponse int = notificationservice.UpdateRule(&rule, ruleId(r), &body)
+	w.WriteHeader(httpsResponse)
+	json.NewEncoder(w).Encode(rule)
+}
+
+func deleteRule(w http.ResponseWriter, r *http.Request) {
+	notificationservice.DeleteRule(ruleId(r))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Rule deleted successfully")
+}
+
+// Inbox of the user
+
+// notificationId reads the id of the path
+func notificationId(r *http.Request) int {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		panic(middlewares.GormError{Code: 400, Message: err.Error(), IsGorm: true})
+	}
+	return id
+}
+
+// queryInt reads a positive number of the query string, fallback when it is missing
+func queryInt(r *http.Request, name string, fallback int) int {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 1 {
+		panic(middlewares.GormError{Code: 400, Message: name + " must be a positive number", IsGorm: true})
+	}
+	return number
+}
+
+func findInbox(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	query := notificatonstruct.InboxQuery{
+		Page:     queryInt(r, "page", 1),
+		Limit:    queryInt(r, "limit", 20),
+		Unread:   r.URL.Query().Get("unread") == "true",
+		Archived: r.URL.Query().Get("archived") == "true",
+	}
+	if query.Limit > 100 {
+		query.Limit = 100
+	}
+
+	var inbox notificationservice.Inbox = notificationservice.FindInbox(userId, query)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(inbox)
+}
+
+func unreadCount(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]int64{"unread": notificationservice.UnreadCount(userId)})
+}
+
+func markAllAsSeen(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]int64{"updated": notificationservice.MarkAllAsSeen(userId)})
+}
+
+func markOwnAsSeen(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	notificationservice.MarkOwnAsSeen(userId, notificationId(r))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Notification marked as seen")
+}
+
+func markOwnAsUnseen(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	notificationservice.MarkOwnAsUnseen(userId, notificationId(r))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Notification marked as unseen")
+}
+
+func archive(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	notificationservice.Archive(userId, notificationId(r))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Notification archived")
+}
+
+func unarchive(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	notificationservice.Unarchive(userId, notificationId(r))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Notification moved to the inbox")
+}
+
+func deleteOwn(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	notificationservice.DeleteOwn(userId, notificationId(r))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Notification deleted")
+}
+
+// Delivery by email and webhook
+
+func findPreferences(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(notificationservice.FindPreferences(userId))
+}
+
+func updatePreferences(w http.ResponseWriter, r *http.Request) {
+	var body notificatonstruct.NotificationPreferences
+	json.NewDecoder(r.Body).Decode(&body)
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	var preferences notificationservice.NotificationPreferences = notificationservice.UpdatePreferences(userId, &body)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(preferences)
+}
+
+func findOwnDeliveries(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(middlewares.UserIDKey).(int)
+
+	var deliveries []notificationservice.NotificationDeliveries
+	var httpsResponse int = notificationservice.FindDeliveries(&deliveries, userId, r.URL.Query().Get("status"))
+	w.WriteHeader(httpsResponse)
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func findDeliveries(w http.ResponseWriter, r *http.Request) {
+	userId := 0
+	if r.URL.Query().Get("user_id") != "" {
+		userId = queryInt(r, "user_id", 0)
+	}
+
+	var deliveries []notificationservice.NotificationDeliveries
+	var httpsResponse int = notificationservice.FindDeliveries(&deliveries, userId, r.URL.Query().Get("status"))
+	w.WriteHeader(httpsResponse)
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func retryDelivery(w http.ResponseWriter, r *http.Request) {
+	notificationservice.RetryDelivery(uint(notificationId(r)))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Delivery queued again")
+}
+
+func findTemplates(w http.ResponseWriter, r *http.Request) {
+	var templates []notificationservice.NotificationTemplates
+	var httpsResponse int = notificationservice.FindTemplates(&templates)
+	w.WriteHeader(httpsResponse)
+	json.NewEncoder(w).Encode(templates)
+}
+
+func saveTemplate(w http.ResponseWriter, r *http.Request) {
+	var body notificatonstruct.NotificationTemplate
+	json.NewDecoder(r.Body).Decode(&body)
+
+	var template notificationservice.NotificationTemplates = notificationservice.SaveTemplate(&body)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(template)
+}
+
+func deleteTemplate(w http.ResponseWriter, r *http.Request) {
+	notificationservice.DeleteTemplate(r.URL.Query().Get("channel"), r.URL.Query().Get("event_type"))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Template deleted successfully")
+}
+
 // Register function
 
 func RegisterSubRoutes(router *mux.Router) {
 	notificationsRouter := router.PathPrefix("/notifications").Subrouter()
 
+	// Rules, they reach the records of every hospital so they need the global scope
+	rulesRouter := notificationsRouter.PathPrefix("/rules").Subrouter()
+	rulesRouter.Use(middlewares.AuthHandler)
+	rulesRouter.Use(middlewares.RequirePermission(permissions.NotificationsWrite))
+	rulesRouter.Use(middlewares.RequirePermission(permissions.ScopeGlobal))
+	rulesRouter.HandleFunc("", findRules).Methods("GET")
+	rulesRouter.HandleFunc("/", findRules).Methods("GET")
+	rulesRouter.HandleFunc("/events", findEventTypes).Methods("GET")
+	rulesRouter.HandleFunc("/{id:[0-9]+}", deleteRule).Methods("DELETE")
+
+	ruleValidator := rulesRouter.NewRoute().Subrouter()
+	ruleValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(notificatonstruct.NotificationRule{})))
+	ruleValidator.HandleFunc("", createRule).Methods("POST")
+	ruleValidator.HandleFunc("/", createRule).Methods("POST")
+	ruleValidator.HandleFunc("/{id:[0-9]+}", updateRule).Methods("PUT")
+
+	// Delivery log and templates of every user, global like the rules
+	deliveryRouter := notificationsRouter.NewRoute().Subrouter()
+	deliveryRouter.Use(middlewares.AuthHandler)
+	deliveryRouter.Use(middlewares.RequirePermission(permissions.NotificationsWrite))
+	deliveryRouter.Use(middlewares.RequirePermission(permissions.ScopeGlobal))
+	deliveryRouter.HandleFunc("/deliveries", findDeliveries).Methods("GET")
+	deliveryRouter.HandleFunc("/deliveries/{id:[0-9]+}/retry", retryDelivery).Methods("POST")
+	deliveryRouter.HandleFunc("/templates", findTemplates).Methods("GET")
+	deliveryRouter.HandleFunc("/templates", deleteTemplate).Methods("DELETE")
+
+	templateValidator := deliveryRouter.NewRoute().Subrouter()
+	templateValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(notificatonstruct.NotificationTemplate{})))
+	templateValidator.HandleFunc("/templates", saveTemplate).Methods("PUT")
+
+	// Inbox, every user reaches their own notifications
+	inboxRouter := notificationsRouter.PathPrefix("/me").Subrouter()
+	inboxRouter.Use(middlewares.AuthHandler)
+	inboxRouter.HandleFunc("", findInbox).Methods("GET")
+	inboxRouter.HandleFunc("/", findInbox).Methods("GET")
+	inboxRouter.HandleFunc("/unread-count", unreadCount).Methods("GET")
+	inboxRouter.HandleFunc("/seen", markAllAsSeen).Methods("PUT")
+	inboxRouter.HandleFunc("/{id:[0-9]+}/seen", markOwnAsSeen).Methods("PUT")
+	inboxRouter.HandleFunc("/{id:[0-9]+}/unseen", markOwnAsUnseen).Methods("PUT")
+	inboxRouter.HandleFunc("/{id:[0-9]+}/archive", archive).Methods("PUT")
+	inboxRouter.HandleFunc("/{id:[0-9]+}/unarchive", unarchive).Methods("PUT")
+	inboxRouter.HandleFunc("/{id:[0-9]+}", deleteOwn).Methods("DELETE")
+	inboxRouter.HandleFunc("/events", notificationservice.NotificationEventsEndpoint).Methods("GET")
+	inboxRouter.HandleFunc("/preferences", findPreferences).Methods("GET")
+	inboxRouter.HandleFunc("/deliveries", findOwnDeliveries).Methods("GET")
+
+	preferencesValidator := inboxRouter.NewRoute().Subrouter()
+	preferencesValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(notificatonstruct.NotificationPreferences{})))
+	preferencesValidator.HandleFunc("/preferences", updatePreferences).Methods("PUT")
+
 	// Protected functions
 	notificationsProtected := notificationsRouter.NewRoute().Subrouter()
 	notificationsProtected.Use(middlewares.AuthHandler)
-	notificationsProtected.Use(middlewares.ProfilesHandler([]uint{1, 2, 7}))
+	notificationsProtected.Use(middlewares.RequirePermission(permissions.NotificationsRead))
 	notificationsProtected.HandleFunc("/", find).Methods("GET")
 	notificationsProtected.HandleFunc("/markAsSeen/{id}", MarkAsSeen).Methods("PUT")
 
 	// ValidatorHandler - Create
-	notificationsCreateValidator := notificationsProtected.NewRoute().Subrouter()
+	notificationsCreateValidator := notificationsRouter.NewRoute().Subrouter()
+	notificationsCreateValidator.Use(middlewares.AuthHandler)
+	notificationsCreateValidator.Use(middlewares.RequirePermission(permissions.NotificationsWrite))
 	notificationsCreateValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(notificatonstruct.NotificationCreate{})))
 	notificationsCreateValidator.HandleFunc("/", create).Methods("POST")
 
-	// Websocket
+	// Broadcasts, to profiles, hospitals or everyone
+	broadcastsRouter := notificationsRouter.NewRoute().Subrouter()
+	broadcastsRouter.Use(middlewares.AuthHandler)
+	broadcastsRouter.Use(middlewares.RequirePermission(permissions.NotificationsWrite))
+	broadcastsRouter.HandleFunc("/broadcasts", findBroadcasts).Methods("GET")
+
+	broadcastValidator := broadcastsRouter.NewRoute().Subrouter()
+	broadcastValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(notificatonstruct.NotificationBroadcast{})))
+	broadcastValidator.HandleFunc("/broadcasts", broadcast).Methods("POST")
+
+	// Websocket, /me/events is the same feed as Server-Sent Events
 	notificationsRouter.HandleFunc("/live", notificationservice.NotificationWebSocketEndpoint).Methods("GET")
 }
@@ -0,0 +1,156 @@
+package notificationservice
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	notificatonstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/notifications/struct"
+	"github.com/Gamequic/LivePreviewBackend/pkg/scope"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+/*
+	Broadcasts. One message is sent to every active user of some profiles, of some hospitals
+	or to everyone. Each recipient gets their own row, so the inbox works the same as with a
+	single notification, and the broadcast keeps who sent it and to whom.
+*/
+
+const broadcastBatch = 500
+
+type NotificationBroadcasts struct {
+	gorm.Model
+	SenderId    int    `gorm:"not null;index"`
+	Message     string `gorm:"not null"`
+	All         bool
+	ProfileIDs  string // ids separated by commas
+	HospitalIDs string // ids separated by commas
+	Recipients  int
+}
+
+func joinIds(ids []uint) string {
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = strconv.Itoa(int(id))
+	}
+	return strings.Join(values, ",")
+}
+
+// recipients are the active users of the target, every user once
+func recipients(target *notificatonstruct.NotificationBroadcast) []int {
+	query := database.DB.Table("users").
+		Where("users.deleted_at IS NULL AND users.deactivated_at IS NULL")
+
+	if !target.All {
+		conditions := []string{}
+		args := []interface{}{}
+		if len(target.ProfileIDs) > 0 {
+			conditions = append(conditions, "users.id IN (SELECT user_id FROM user_profiles WHERE profile_id IN ?)")
+			args = append(args, target.ProfileIDs)
+		}
+		if len(target.HospitalIDs) > 0 {
+			// Staff of the hospital and staff of the doctors that work there
+			conditions = append(conditions,
+				"users.id IN (SELECT user_id FROM user_hospitals WHERE hospital_id IN ?)",
+				"users.id IN (SELECT user_doctors.user_id FROM user_doctors JOIN doctor_hospitals ON doctor_hospitals.doctor_id = user_doctors.doctor_id WHERE doctor_hospitals.hospital_id IN ?)")
+			args = append(args, target.HospitalIDs, target.HospitalIDs)
+		}
+		query = query.Where("("+strings.Join(conditions, " OR ")+")", args...)
+	}
+
+	var userIds []int
+	if err := query.Order("users.id").Pluck("users.id", &userIds).Error; err != nil {
+		panic(err)
+	}
+	return userIds
+}
+
+// Broadcast sends the message to every user of the target. Outside the global scope only the
+// hospitals of the sender can be targeted
+func Broadcast(target *notificatonstruct.NotificationBroadcast, senderId int, sc scope.Scope) NotificationBroadcasts {
+	if !target.All && len(target.ProfileIDs) == 0 && len(target.HospitalIDs) == 0 {
+		panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Choose all, some profiles or some hospitals", IsGorm: true})
+	}
+	if !sc.Global {
+		if target.All || len(target.ProfileIDs) > 0 {
+			panic(middlewares.GormError{Code: http.StatusForbidden, Message: "Only the hospitals of your scope can be targeted", IsGorm: true})
+		}
+		for _, hospitalId := range target.HospitalIDs {
+			if !sc.Allows(hospitalId, 0) {
+				panic(middlewares.GormError{Code: http.StatusForbidden, Message: "Only the hospitals of your scope can be targeted", IsGorm: true})
+			}
+		}
+	}
+
+	userIds := recipients(target)
+	broadcast := NotificationBroadcasts{
+		SenderId:    senderId,
+		Message:     target.Message,
+		All:         target.All,
+		ProfileIDs:  joinIds(target.ProfileIDs),
+		HospitalIDs: joinIds(target.HospitalIDs),
+		Recipients:  len(userIds),
+	}
+
+	notifications := make([]Notifications, len(userIds))
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&broadcast).Error; err != nil {
+			return err
+		}
+		if len(notifications) == 0 {
+			return nil
+		}
+
+		for i, userId := range userIds {
+			notifications[i] = Notifications{
+				UserId:      userId,
+				Message:     target.Message,
+				SenderId:    &senderId,
+				BroadcastId: &broadcast.ID,
+			}
+		}
+		return tx.Omit("User").CreateInBatches(&notifications, broadcastBatch).Error
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	publishInBatches(notifications)
+	dispatch(notifications, "", nil)
+
+	Logger.Info(fmt.Sprintf("Broadcast %d sent by user %d to %d users", broadcast.ID, senderId, len(userIds)))
+	return broadcast
+}
+
+// publishInBatches sends stored notifications to the live feed, a failure only delays the
+// live feed, the inbox already has them
+func publishInBatches(notifications []Notifications) {
+	ctx := context.Background()
+	for start := 0; start < len(notifications); start += broadcastBatch {
+		end := start + broadcastBatch
+		if end > len(notifications) {
+			end = len(notifications)
+		}
+		if err := publish(ctx, notifications[start:end]); err != nil {
+			Logger.Error("Failed to publish notifications to Redis", zap.Int("count", end-start), zap.Error(err))
+		}
+	}
+}
+
+// FindBroadcasts returns the broadcasts, outside the global scope only the ones of the user
+func FindBroadcasts(broadcasts *[]NotificationBroadcasts, sc scope.Scope) int {
+	query := database.DB.Order("created_at DESC")
+	if !sc.Global {
+		query = query.Where("sender_id = ?", sc.UserID)
+	}
+	if err := query.Find(broadcasts).Error; err != nil {
+		panic(err)
+	}
+	return http.StatusOK
+}
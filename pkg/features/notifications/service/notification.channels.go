@@ -0,0 +1,140 @@
+package notificationservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/mailer"
+)
+
+/*
+	Delivery channels out of the app. The inbox and the live feed always get the notification,
+	these are extra copies chosen by each user in their preferences.
+	A channel only sends, the retries and the log of each attempt are in notification.delivery.go
+*/
+
+const (
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+)
+
+// Channel sends one delivery, an error means it is tried again later
+type Channel interface {
+	Send(ctx context.Context, delivery *NotificationDeliveries) error
+}
+
+var channels = map[string]Channel{}
+
+// initChannels registers the channels of the app, after the .env is loaded
+func initChannels() {
+	RegisterChannel(ChannelEmail, emailChannel{})
+	RegisterChannel(ChannelWebhook, newWebhookChannel())
+}
+
+// RegisterChannel adds or replaces a channel, the deliveries with that name go through it
+func RegisterChannel(name string, channel Channel) {
+	channels[name] = channel
+}
+
+// Email, sent with the mailer so MAIL_DRIVER chooses SMTP or the outbox folder
+type emailChannel struct{}
+
+func (emailChannel) Send(ctx context.Context, delivery *NotificationDeliveries) error {
+	return mailer.Send(mailer.Message{
+		To:      []string{delivery.Target},
+		Subject: delivery.Subject,
+		Text:    delivery.Body,
+	})
+}
+
+// Webhook, the body is posted as JSON and signed with the secret of the user on
+// X-Signature: sha256=<hex of the HMAC of the body>
+type webhookChannel struct {
+	client *http.Client
+}
+
+// ErrPrivateAddress is returned when a webhook points to the internal network
+var ErrPrivateAddress = errors.New("webhook address is private")
+
+func newWebhookChannel() webhookChannel {
+	timeout := 10 * time.Second
+	if seconds, err := strconv.Atoi(os.Getenv("WEBHOOK_TIMEOUT_SECONDS")); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	// Checked when connecting, after the name is resolved, so DNS can not point it inside
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if allowPrivateWebhooks() {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+				return ErrPrivateAddress
+			}
+			return nil
+		},
+	}
+
+	return webhookChannel{client: &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		// A redirect could go to the internal network or repeat the post somewhere else
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}}
+}
+
+// WEBHOOK_ALLOW_PRIVATE lets the webhooks reach the local network, for development
+func allowPrivateWebhooks() bool {
+	allow, _ := strconv.ParseBool(os.Getenv("WEBHOOK_ALLOW_PRIVATE"))
+	return allow
+}
+
+// SignWebhook is the signature of the body, receivers compute it again to check it
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c webhookChannel) Send(ctx context.Context, delivery *NotificationDeliveries) error {
+	var preferences NotificationPreferences
+	findPreferences(&preferences, delivery.UserId)
+
+	body := []byte(delivery.Body)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "ArenasCRM-Webhooks/1.0")
+	request.Header.Set("X-Delivery-Id", strconv.Itoa(int(delivery.ID)))
+	request.Header.Set("X-Signature", SignWebhook(preferences.WebhookSecret, body))
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %d", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package notificationservice
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/mailer"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const findPreferencesQuery = `SELECT * FROM "notification_preferences" WHERE "notification_preferences"."user_id" = $1`
+
+func expectPreferences(mock sqlmock.Sqlmock, userId int, secret string) {
+	mock.ExpectQuery(regexp.QuoteMeta(findPreferencesQuery)).
+		WithArgs(userId, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "webhook", "webhook_url", "webhook_secret"}).
+			AddRow(userId, true, "", secret))
+}
+
+func TestWebhookIsSignedWithTheSecretOfTheUser(t *testing.T) {
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE", "true") // the test server listens on the loopback
+	mock := mockDB(t)
+	expectPreferences(mock, 3, "s3cret")
+
+	received := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		// What a receiver does to trust the call
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		if r.Header.Get("X-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		received <- r
+	}))
+	defer server.Close()
+
+	delivery := NotificationDeliveries{Model: gorm.Model{ID: 12}, UserId: 3, Channel: ChannelWebhook, Target: server.URL, Body: `{"event":"notification"}`}
+	if err := newWebhookChannel().Send(context.Background(), &delivery); err != nil {
+		t.Fatalf("webhook failed: %v", err)
+	}
+
+	request := <-received
+	if request.Method != http.MethodPost || request.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got %s with %q", request.Method, request.Header.Get("Content-Type"))
+	}
+	if request.Header.Get("X-Delivery-Id") != "12" {
+		t.Errorf("X-Delivery-Id is %q, want 12", request.Header.Get("X-Delivery-Id"))
+	}
+}
+
+func TestWebhookWithAnotherSecretIsRejected(t *testing.T) {
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE", "true")
+	mock := mockDB(t)
+	expectPreferences(mock, 3, "rotated")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Signature") != SignWebhook("s3cret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	delivery := NotificationDeliveries{UserId: 3, Channel: ChannelWebhook, Target: server.URL, Body: `{}`}
+	err := newWebhookChannel().Send(context.Background(), &delivery)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected the answer 401 as the error, got %v", err)
+	}
+}
+
+func TestWebhookToPrivateAddressIsBlocked(t *testing.T) {
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE", "")
+	mock := mockDB(t)
+	expectPreferences(mock, 3, "s3cret")
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer server.Close()
+
+	delivery := NotificationDeliveries{UserId: 3, Channel: ChannelWebhook, Target: server.URL, Body: `{}`}
+	err := newWebhookChannel().Send(context.Background(), &delivery)
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("expected ErrPrivateAddress, got %v", err)
+	}
+	if calls.Load() != 0 {
+		t.Error("the request reached the private address")
+	}
+}
+
+func TestWebhookRedirectIsNotFollowed(t *testing.T) {
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE", "true")
+	mock := mockDB(t)
+	expectPreferences(mock, 3, "s3cret")
+
+	var followed atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			followed.Add(1)
+			return
+		}
+		http.Redirect(w, r, "/moved", http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+
+	delivery := NotificationDeliveries{UserId: 3, Channel: ChannelWebhook, Target: server.URL, Body: `{}`}
+	if err := newWebhookChannel().Send(context.Background(), &delivery); err == nil {
+		t.Error("a redirect counted as delivered")
+	}
+	if followed.Load() != 0 {
+		t.Error("the redirect was followed")
+	}
+}
+
+// fakeSMTP answers like a mail server, each message received is sent on the channel.
+// rcpt is the answer to RCPT TO, so the server can refuse the recipient
+func fakeSMTP(t *testing.T, rcpt string) (*mailer.SMTPSender, chan string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, rcpt, messages)
+		}
+	}()
+
+	previousSender, previousLogger := mailer.DefaultSender, mailer.Logger
+	sender := &mailer.SMTPSender{Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port, From: "crm@example.com"}
+	mailer.DefaultSender = sender
+	mailer.Logger = zap.NewNop()
+	t.Cleanup(func() {
+		mailer.DefaultSender, mailer.Logger = previousSender, previousLogger
+	})
+	return sender, messages
+}
+
+func serveSMTP(conn net.Conn, rcpt string, messages chan string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "RCPT"):
+			reply(rcpt)
+		case command == "DATA":
+			reply("354 end with .")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			messages <- data.String()
+			reply("250 queued")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestEmailDeliveryIsSentBySMTP(t *testing.T) {
+	_, messages := fakeSMTP(t, "250 ok")
+	mock := mockDB(t)
+
+	mock.ExpectExec(regexp.QuoteMeta(updateDelivery+`"attempts"=$1,"last_error"=$2,"sent_at"=$3,"status"=$4`)).
+		WithArgs(1, "", around{0}, DeliverySent, sqlmock.AnyArg(), 8).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	RegisterChannel(ChannelEmail, emailChannel{})
+	attempt(&NotificationDeliveries{
+		Model:   gorm.Model{ID: 8},
+		Channel: ChannelEmail,
+		Target:  "ana@example.com",
+		Subject: "Piece A-12 signed",
+		Body:    "The report is ready",
+	})
+
+	message := <-messages
+	for _, expected := range []string{"To: ana@example.com", "Subject: Piece A-12 signed", "The report is ready"} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("the email does not have %q:\n%s", expected, message)
+		}
+	}
+}
+
+func TestEmailRefusedBySMTPIsRetried(t *testing.T) {
+	fakeSMTP(t, "550 no such user")
+	mock := mockDB(t)
+
+	mock.ExpectExec(regexp.QuoteMeta(updateDelivery+`"attempts"=$1,"last_error"=$2,"next_attempt_at"=$3`)).
+		WithArgs(1, sqlmock.AnyArg(), around{deliveryFirstRetry}, sqlmock.AnyArg(), 8).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	RegisterChannel(ChannelEmail, emailChannel{})
+	delivery := NotificationDeliveries{Model: gorm.Model{ID: 8}, Channel: ChannelEmail, Target: "nobody@example.com", Body: "Hi"}
+	attempt(&delivery)
+
+	if delivery.Attempts != 1 {
+		t.Errorf("attempts is %d, want 1", delivery.Attempts)
+	}
+}
@@ -0,0 +1,371 @@
+package notificationservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	notificatonstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/notifications/struct"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/*
+	Every copy of a notification for a channel is a delivery. It is stored before sending, a
+	worker sends the due ones and a failure is tried again later, each time waiting twice as
+	long, until NOTIFICATION_DELIVERY_MAX_ATTEMPTS. The table is also the log of what was sent.
+	Several instances of the API can run the worker, a delivery is taken by only one of them.
+*/
+
+const (
+	DeliveryPending = "pending"
+	DeliverySent    = "sent"
+	DeliveryFailed  = "failed"
+)
+
+const (
+	deliveryBatch      = 20
+	deliveryPoll       = 15 * time.Second
+	deliveryLease      = 5 * time.Minute // a delivery taken by a worker that died is retried after this
+	deliveryFirstRetry = 30 * time.Second
+	deliveryMaxBackoff = time.Hour
+)
+
+type NotificationDeliveries struct {
+	gorm.Model
+	NotificationId uint       `gorm:"index;not null"`
+	UserId         int        `gorm:"index;not null"`
+	Channel        string     `gorm:"not null"`
+	Target         string     `gorm:"not null"` // email or webhook address
+	Subject        string     `json:",omitempty"`
+	Body           string     `gorm:"not null" json:"-"`
+	Status         string     `gorm:"index;not null"`
+	Attempts       int        `gorm:"not null;default:0"`
+	LastError      string     `json:",omitempty"`
+	NextAttemptAt  time.Time  `gorm:"index"`
+	SentAt         *time.Time `json:",omitempty"`
+}
+
+// Message of a channel for an event, the ones without event type are for everything else
+type NotificationTemplates struct {
+	Channel   string `gorm:"primaryKey" json:"channel"`
+	EventType string `gorm:"primaryKey" json:"event_type"`
+	Subject   string `json:"subject"`
+	Body      string `gorm:"not null" json:"body"`
+	UpdatedAt time.Time
+}
+
+// Used when there is no template for the channel
+var defaultTemplates = map[string]NotificationTemplates{
+	ChannelEmail:   {Channel: ChannelEmail, Subject: "New notification", Body: "{message}"},
+	ChannelWebhook: {Channel: ChannelWebhook, Body: "{message}"},
+}
+
+var wakeDeliveries = make(chan struct{}, 1)
+
+func maxDeliveryAttempts() int {
+	attempts, err := strconv.Atoi(os.Getenv("NOTIFICATION_DELIVERY_MAX_ATTEMPTS"))
+	if err != nil || attempts <= 0 {
+		return 6
+	}
+	return attempts
+}
+
+// template picks the template of the event, then the general one, then the default
+func template(channel string, eventType string) NotificationTemplates {
+	var templates []NotificationTemplates
+	database.DB.Where("channel = ? AND event_type IN ?", channel, []string{eventType, ""}).Find(&templates)
+	for _, found := range templates {
+		if found.EventType == eventType {
+			return found
+		}
+	}
+	if len(templates) > 0 {
+		return templates[0]
+	}
+	return defaultTemplates[channel]
+}
+
+// dispatch queues the copies of the notifications for the channels each user chose, the
+// placeholders are the data of the event plus {message}
+func dispatch(notifications []Notifications, eventType string, data map[string]interface{}) {
+	if len(notifications) == 0 {
+		return
+	}
+
+	userIds := make([]int, len(notifications))
+	for i := range notifications {
+		userIds[i] = notifications[i].UserId
+	}
+
+	var preferences []NotificationPreferences
+	database.DB.Where("user_id IN ? AND (email = ? OR webhook = ?)", userIds, true, true).Find(&preferences)
+	if len(preferences) == 0 {
+		return
+	}
+	byUser := map[int]NotificationPreferences{}
+	for _, preference := range preferences {
+		byUser[preference.UserId] = preference
+	}
+
+	var users []struct {
+		ID    int
+		Email string
+	}
+	database.DB.Table("users").
+		Where("id IN ? AND deleted_at IS NULL AND deactivated_at IS NULL", userIds).
+		Select("id, email").
+		Scan(&users)
+	emails := map[int]string{}
+	for _, user := range users {
+		emails[user.ID] = user.Email
+	}
+
+	emailTemplate := template(ChannelEmail, eventType)
+	webhookTemplate := template(ChannelWebhook, eventType)
+
+	now := time.Now()
+	deliveries := []NotificationDeliveries{}
+	for _, notification := range notifications {
+		preference, found := byUser[notification.UserId]
+		email, active := emails[notification.UserId]
+		if !found || !active {
+			continue
+		}
+
+		values := map[string]interface{}{"message": notification.Message}
+		for key, value := range data {
+			values[key] = value
+		}
+
+		base := NotificationDeliveries{
+			NotificationId: notification.ID,
+			UserId:         notification.UserId,
+			Status:         DeliveryPending,
+			NextAttemptAt:  now,
+		}
+
+		if preference.Email && email != "" {
+			delivery := base
+			delivery.Channel = ChannelEmail
+			delivery.Target = email
+			delivery.Subject = render(emailTemplate.Subject, values)
+			delivery.Body = render(emailTemplate.Body, values)
+			deliveries = append(deliveries, delivery)
+		}
+
+		if preference.Webhook && preference.WebhookURL != "" {
+			// Sent by hand or broadcast when there is no event
+			event := eventType
+			if event == "" {
+				event = "notification"
+			}
+			payload, err := json.Marshal(map[string]interface{}{
+				"event":           event,
+				"notification_id": notification.ID,
+				"user_id":         notification.UserId,
+				"message":         render(webhookTemplate.Body, values),
+				"data":            data,
+				"created_at":      notification.CreatedAt,
+			})
+			if err != nil {
+				Logger.Error("Error building webhook payload", zap.Error(err))
+				continue
+			}
+			delivery := base
+			delivery.Channel = ChannelWebhook
+			delivery.Target = preference.WebhookURL
+			delivery.Body = string(payload)
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+
+	if err := database.DB.CreateInBatches(&deliveries, broadcastBatch).Error; err != nil {
+		Logger.Error("Error queueing notification deliveries", zap.Error(err))
+		return
+	}
+
+	select {
+	case wakeDeliveries <- struct{}{}:
+	default:
+	}
+}
+
+// startDeliveryWorker sends the due deliveries, when woken up by dispatch or every poll
+func startDeliveryWorker() {
+	go func() {
+		ticker := time.NewTicker(deliveryPoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-wakeDeliveries:
+			case <-ticker.C:
+			}
+			for sendDue() == deliveryBatch {
+			}
+		}
+	}()
+}
+
+// sendDue takes a batch of due deliveries and sends them, returns how many were taken
+func sendDue() int {
+	var deliveries []NotificationDeliveries
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", DeliveryPending, time.Now()).
+			Order("next_attempt_at").
+			Limit(deliveryBatch).
+			Find(&deliveries).Error
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+
+		ids := make([]uint, len(deliveries))
+		for i := range deliveries {
+			ids[i] = deliveries[i].ID
+		}
+		return tx.Model(&NotificationDeliveries{}).Where("id IN ?", ids).
+			Update("next_attempt_at", time.Now().Add(deliveryLease)).Error
+	})
+	if err != nil {
+		Logger.Error("Error taking notification deliveries", zap.Error(err))
+		return 0
+	}
+
+	for i := range deliveries {
+		attempt(&deliveries[i])
+	}
+	return len(deliveries)
+}
+
+// attempt sends one delivery and records the result
+func attempt(delivery *NotificationDeliveries) {
+	err := send(delivery)
+
+	delivery.Attempts++
+	values := map[string]interface{}{"attempts": delivery.Attempts}
+	if err == nil {
+		now := time.Now()
+		values["status"] = DeliverySent
+		values["sent_at"] = now
+		values["last_error"] = ""
+	} else if delivery.Attempts >= maxDeliveryAttempts() {
+		values["status"] = DeliveryFailed
+		values["last_error"] = err.Error()
+		Logger.Error(fmt.Sprintf("Delivery %d by %s failed after %d attempts", delivery.ID, delivery.Channel, delivery.Attempts), zap.Error(err))
+	} else {
+		backoff := deliveryFirstRetry << (delivery.Attempts - 1)
+		if backoff > deliveryMaxBackoff || backoff <= 0 {
+			backoff = deliveryMaxBackoff
+		}
+		values["next_attempt_at"] = time.Now().Add(backoff)
+		values["last_error"] = err.Error()
+		Logger.Info(fmt.Sprintf("Delivery %d by %s failed, next attempt in %s", delivery.ID, delivery.Channel, backoff), zap.Error(err))
+	}
+
+	if err := database.DB.Model(delivery).Updates(values).Error; err != nil {
+		Logger.Error("Error saving delivery result", zap.Uint("delivery", delivery.ID), zap.Error(err))
+	}
+}
+
+// send runs the channel, a panic of the channel counts as a failure
+func send(delivery *NotificationDeliveries) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("channel failed: %v", recovered)
+		}
+	}()
+
+	channel, found := channels[delivery.Channel]
+	if !found {
+		return fmt.Errorf("unknown channel %s", delivery.Channel)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return channel.Send(ctx, delivery)
+}
+
+// Log of the deliveries
+
+// FindDeliveries returns the last deliveries, of a user when userId is not 0
+func FindDeliveries(deliveries *[]NotificationDeliveries, userId int, status string) int {
+	query := database.DB.Order("created_at DESC").Limit(200)
+	if userId != 0 {
+		query = query.Where("user_id = ?", userId)
+	}
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Find(deliveries).Error; err != nil {
+		panic(err)
+	}
+	return http.StatusOK
+}
+
+// RetryDelivery sends a failed delivery again with a fresh count of attempts
+func RetryDelivery(id uint) {
+	result := database.DB.Model(&NotificationDeliveries{}).
+		Where("id = ? AND status = ?", id, DeliveryFailed).
+		Updates(map[string]interface{}{"status": DeliveryPending, "attempts": 0, "next_attempt_at": time.Now()})
+	if result.Error != nil {
+		panic(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		panic(middlewares.GormError{Code: http.StatusNotFound, Message: "Failed delivery not found", IsGorm: true})
+	}
+
+	select {
+	case wakeDeliveries <- struct{}{}:
+	default:
+	}
+}
+
+// Templates
+
+func FindTemplates(templates *[]NotificationTemplates) int {
+	if err := database.DB.Order("channel, event_type").Find(templates).Error; err != nil {
+		panic(err)
+	}
+	return http.StatusOK
+}
+
+// SaveTemplate creates or replaces the template of the channel and event
+func SaveTemplate(body *notificatonstruct.NotificationTemplate) NotificationTemplates {
+	if body.EventType != "" && !validEventType(body.EventType) {
+		panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Unknown event type", IsGorm: true})
+	}
+
+	template := NotificationTemplates{
+		Channel:   body.Channel,
+		EventType: body.EventType,
+		Subject:   body.Subject,
+		Body:      body.Body,
+	}
+	if err := database.DB.Save(&template).Error; err != nil {
+		panic(err)
+	}
+	return template
+}
+
+// DeleteTemplate goes back to the general or default template
+func DeleteTemplate(channel string, eventType string) {
+	result := database.DB.Where("channel = ? AND event_type = ?", channel, eventType).Delete(&NotificationTemplates{})
+	if result.Error != nil {
+		panic(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		panic(middlewares.GormError{Code: http.StatusNotFound, Message: "Template not found", IsGorm: true})
+	}
+}
@@ -0,0 +1,292 @@
+package notificationservice
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// mockDB points database.DB to a mock, every query the test does not expect fails it
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: conn}), &gorm.Config{
+		SkipDefaultTransaction: true,
+		Logger:                 logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := database.DB
+	database.DB = db
+	Logger = zap.NewNop()
+	t.Cleanup(func() {
+		database.DB = previous
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return mock
+}
+
+// fakeChannel records the deliveries it gets and answers with err
+type fakeChannel struct {
+	err  error
+	sent []*NotificationDeliveries
+}
+
+func (c *fakeChannel) Send(ctx context.Context, delivery *NotificationDeliveries) error {
+	c.sent = append(c.sent, delivery)
+	return c.err
+}
+
+func registerFake(t *testing.T, err error) *fakeChannel {
+	t.Helper()
+	channel := &fakeChannel{err: err}
+	RegisterChannel("fake", channel)
+	t.Cleanup(func() { delete(channels, "fake") })
+	return channel
+}
+
+// around matches a time within a second of now plus after
+type around struct {
+	after time.Duration
+}
+
+func (a around) Match(value driver.Value) bool {
+	moment, ok := value.(time.Time)
+	if !ok {
+		return false
+	}
+	expected := time.Now().Add(a.after)
+	return moment.After(expected.Add(-time.Second)) && moment.Before(expected.Add(time.Second))
+}
+
+// recorder matches anything and keeps it, to look at the values of an insert
+type recorder struct {
+	values *[]driver.Value
+}
+
+func (r recorder) Match(value driver.Value) bool {
+	*r.values = append(*r.values, value)
+	return true
+}
+
+const updateDelivery = `UPDATE "notification_deliveries" SET `
+
+func TestAttemptSchedulesRetryWithBackoff(t *testing.T) {
+	t.Setenv("NOTIFICATION_DELIVERY_MAX_ATTEMPTS", "100")
+	cases := []struct {
+		attempts int
+		backoff  time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, time.Minute},
+		{3, 4 * time.Minute},
+		{7, time.Hour}, // 30s << 7 is over the maximum
+		{70, time.Hour},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprint(c.attempts), func(t *testing.T) {
+			mock := mockDB(t)
+			registerFake(t, errors.New("connection refused"))
+
+			mock.ExpectExec(regexp.QuoteMeta(updateDelivery+`"attempts"=$1,"last_error"=$2,"next_attempt_at"=$3,"updated_at"=$4`)).
+				WithArgs(c.attempts+1, "connection refused", around{c.backoff}, sqlmock.AnyArg(), 7).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			delivery := NotificationDeliveries{Model: gorm.Model{ID: 7}, Channel: "fake", Attempts: c.attempts, Status: DeliveryPending}
+			attempt(&delivery)
+
+			if delivery.Attempts != c.attempts+1 {
+				t.Errorf("attempts is %d, want %d", delivery.Attempts, c.attempts+1)
+			}
+		})
+	}
+}
+
+func TestAttemptMarksFailedAfterMaxAttempts(t *testing.T) {
+	t.Setenv("NOTIFICATION_DELIVERY_MAX_ATTEMPTS", "3")
+	mock := mockDB(t)
+	registerFake(t, errors.New("timeout"))
+
+	mock.ExpectExec(regexp.QuoteMeta(updateDelivery+`"attempts"=$1,"last_error"=$2,"status"=$3,"updated_at"=$4`)).
+		WithArgs(3, "timeout", DeliveryFailed, sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	delivery := NotificationDeliveries{Model: gorm.Model{ID: 7}, Channel: "fake", Attempts: 2, Status: DeliveryPending}
+	attempt(&delivery)
+}
+
+func TestAttemptMarksSent(t *testing.T) {
+	mock := mockDB(t)
+	channel := registerFake(t, nil)
+
+	mock.ExpectExec(regexp.QuoteMeta(updateDelivery+`"attempts"=$1,"last_error"=$2,"sent_at"=$3,"status"=$4,"updated_at"=$5`)).
+		WithArgs(1, "", around{0}, DeliverySent, sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	delivery := NotificationDeliveries{Model: gorm.Model{ID: 7}, Channel: "fake", Status: DeliveryPending}
+	attempt(&delivery)
+
+	if len(channel.sent) != 1 || channel.sent[0] != &delivery {
+		t.Errorf("the channel got %d deliveries, want the one attempted", len(channel.sent))
+	}
+}
+
+func TestAttemptCountsPanicsAndUnknownChannels(t *testing.T) {
+	mock := mockDB(t)
+	RegisterChannel("panics", panicChannel{})
+	t.Cleanup(func() { delete(channels, "panics") })
+
+	mock.ExpectExec(regexp.QuoteMeta(updateDelivery)).
+		WithArgs(1, "channel failed: boom", around{deliveryFirstRetry}, sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(updateDelivery)).
+		WithArgs(1, "unknown channel missing", around{deliveryFirstRetry}, sqlmock.AnyArg(), 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	attempt(&NotificationDeliveries{Model: gorm.Model{ID: 1}, Channel: "panics"})
+	attempt(&NotificationDeliveries{Model: gorm.Model{ID: 2}, Channel: "missing"})
+}
+
+type panicChannel struct{}
+
+func (panicChannel) Send(context.Context, *NotificationDeliveries) error {
+	panic("boom")
+}
+
+func TestSendDueLeasesAndSendsTheBatch(t *testing.T) {
+	mock := mockDB(t)
+	channel := registerFake(t, nil)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT \* FROM "notification_deliveries" WHERE \(status = \$1 AND next_attempt_at <= \$2\) .* ORDER BY next_attempt_at LIMIT \$3 FOR UPDATE SKIP LOCKED`).
+		WithArgs(DeliveryPending, around{0}, deliveryBatch).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "channel", "target", "status", "attempts"}).
+			AddRow(4, "fake", "ana@example.com", DeliveryPending, 0).
+			AddRow(5, "fake", "luis@example.com", DeliveryPending, 2))
+	mock.ExpectExec(regexp.QuoteMeta(updateDelivery+`"next_attempt_at"=$1,"updated_at"=$2 WHERE id IN ($3,$4)`)).
+		WithArgs(around{deliveryLease}, sqlmock.AnyArg(), 4, 5).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta(updateDelivery)).
+		WithArgs(1, "", around{0}, DeliverySent, sqlmock.AnyArg(), 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(updateDelivery)).
+		WithArgs(3, "", around{0}, DeliverySent, sqlmock.AnyArg(), 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if taken := sendDue(); taken != 2 {
+		t.Errorf("sendDue took %d deliveries, want 2", taken)
+	}
+	if len(channel.sent) != 2 || channel.sent[0].Target != "ana@example.com" || channel.sent[1].Target != "luis@example.com" {
+		t.Errorf("the channel did not get the batch in order: %+v", channel.sent)
+	}
+}
+
+func TestSendDueWithNothingDue(t *testing.T) {
+	mock := mockDB(t)
+	registerFake(t, nil)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT \* FROM "notification_deliveries" .* FOR UPDATE SKIP LOCKED`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectCommit()
+
+	if taken := sendDue(); taken != 0 {
+		t.Errorf("sendDue took %d deliveries, want 0", taken)
+	}
+}
+
+func TestDispatchQueuesTheChosenChannels(t *testing.T) {
+	mock := mockDB(t)
+
+	// A wake up left by another test would hide the one of this dispatch
+	select {
+	case <-wakeDeliveries:
+	default:
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "notification_preferences" WHERE user_id IN ($1,$2) AND (email = $3 OR webhook = $4)`)).
+		WithArgs(1, 2, true, true).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "email", "webhook", "webhook_url"}).
+			AddRow(1, true, true, "https://hooks.example.com/crm").
+			AddRow(2, true, false, ""))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, email FROM "users" WHERE id IN ($1,$2) AND deleted_at IS NULL AND deactivated_at IS NULL`)).
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email"}).AddRow(1, "ana@example.com"))
+	mock.ExpectQuery(`SELECT \* FROM "notification_templates" WHERE channel = \$1`).
+		WithArgs(ChannelEmail, "piece_signed", "").
+		WillReturnRows(sqlmock.NewRows([]string{"channel", "event_type", "subject", "body"}).
+			AddRow(ChannelEmail, "piece_signed", "Piece {piece} signed", "{message} by {by}"))
+	mock.ExpectQuery(`SELECT \* FROM "notification_templates" WHERE channel = \$1`).
+		WithArgs(ChannelWebhook, "piece_signed", "").
+		WillReturnRows(sqlmock.NewRows([]string{"channel", "event_type", "body"}))
+
+	// Two deliveries of 14 columns, user 2 is not active so nothing is queued for them
+	var values []driver.Value
+	args := make([]driver.Value, 28)
+	for i := range args {
+		args[i] = recorder{&values}
+	}
+	mock.ExpectQuery(`INSERT INTO "notification_deliveries"`).
+		WithArgs(args...).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+
+	dispatch([]Notifications{
+		{Model: gorm.Model{ID: 10}, UserId: 1, Message: "Report ready"},
+		{Model: gorm.Model{ID: 11}, UserId: 2, Message: "Report ready"},
+	}, "piece_signed", map[string]interface{}{"piece": "A-12", "by": "Luis"})
+
+	for _, expected := range []driver.Value{
+		ChannelEmail, "ana@example.com", "Piece A-12 signed", "Report ready by Luis",
+		ChannelWebhook, "https://hooks.example.com/crm",
+	} {
+		if !containsValue(values, expected) {
+			t.Errorf("the deliveries do not have %v: %v", expected, values)
+		}
+	}
+
+	select {
+	case <-wakeDeliveries:
+	default:
+		t.Error("dispatch did not wake the worker up")
+	}
+}
+
+func TestDispatchWithoutChannelsQueuesNothing(t *testing.T) {
+	mock := mockDB(t)
+
+	mock.ExpectQuery(`SELECT \* FROM "notification_preferences"`).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+
+	dispatch([]Notifications{{Model: gorm.Model{ID: 10}, UserId: 1, Message: "Hi"}}, "", nil)
+}
+
+func containsValue(values []driver.Value, expected driver.Value) bool {
+	for _, value := range values {
+		if value == expected {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package notificationservice
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	notificatonstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/notifications/struct"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+
+	"gorm.io/gorm"
+)
+
+/*
+	Inbox of the authenticated user, every query is bound to their UserId so nobody reads
+	or changes the notifications of someone else. Archived ones are hidden from the inbox
+	unless asked for, deleted ones are gone for the user.
+*/
+
+// Inbox is a page of notifications plus the counters for the badge
+type Inbox struct {
+	Items  []Notifications `json:"items"`
+	Total  int64           `json:"total"`  // matching the filters
+	Unread int64           `json:"unread"` // of the whole inbox, archived excluded
+	Page   int             `json:"page"`
+	Limit  int             `json:"limit"`
+}
+
+func inboxOf(userId int) *gorm.DB {
+	return database.DB.Model(&Notifications{}).Where("user_id = ?", userId)
+}
+
+// FindInbox returns a page of the notifications of the user, newest first
+func FindInbox(userId int, query notificatonstruct.InboxQuery) Inbox {
+	filtered := inboxOf(userId)
+	if query.Archived {
+		filtered = filtered.Where("archived_at IS NOT NULL")
+	} else {
+		filtered = filtered.Where("archived_at IS NULL")
+	}
+	if query.Unread {
+		filtered = filtered.Where("seen = ?", false)
+	}
+
+	inbox := Inbox{Items: []Notifications{}, Page: query.Page, Limit: query.Limit}
+	if err := filtered.Count(&inbox.Total).Error; err != nil {
+		panic(err)
+	}
+
+	err := filtered.
+		Order("created_at DESC, id DESC").
+		Offset((query.Page - 1) * query.Limit).
+		Limit(query.Limit).
+		Find(&inbox.Items).Error
+	if err != nil {
+		panic(err)
+	}
+
+	inbox.Unread = UnreadCount(userId)
+	return inbox
+}
+
+// UnreadCount is the number of unseen notifications not archived
+func UnreadCount(userId int) int64 {
+	var count int64
+	if err := inboxOf(userId).Where("seen = ? AND archived_at IS NULL", false).Count(&count).Error; err != nil {
+		panic(err)
+	}
+	return count
+}
+
+// updateOwn changes one notification of the user, 404 when it is not theirs
+func updateOwn(userId int, notificationId int, values map[string]interface{}) {
+	result := inboxOf(userId).Where("id = ?", notificationId).Updates(values)
+	if result.Error != nil {
+		panic(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		panic(middlewares.GormError{Code: http.StatusNotFound, Message: "Message not found", IsGorm: true})
+	}
+}
+
+// MarkOwnAsSeen marks one notification of the user as seen
+func MarkOwnAsSeen(userId int, notificationId int) {
+	updateOwn(userId, notificationId, map[string]interface{}{"seen": true, "seen_at": time.Now()})
+}
+
+// MarkOwnAsUnseen puts a notification of the user back as unread
+func MarkOwnAsUnseen(userId int, notificationId int) {
+	updateOwn(userId, notificationId, map[string]interface{}{"seen": false, "seen_at": nil})
+}
+
+// MarkAllAsSeen marks every unseen notification of the user, returns how many changed
+func MarkAllAsSeen(userId int) int64 {
+	result := inboxOf(userId).Where("seen = ?", false).Updates(map[string]interface{}{"seen": true, "seen_at": time.Now()})
+	if result.Error != nil {
+		panic(result.Error)
+	}
+	return result.RowsAffected
+}
+
+// Archive hides a notification of the user from the inbox, archiving also marks it as seen
+func Archive(userId int, notificationId int) {
+	now := time.Now()
+	updateOwn(userId, notificationId, map[string]interface{}{"archived_at": now, "seen": true, "seen_at": now})
+}
+
+// Unarchive brings back an archived notification to the inbox
+func Unarchive(userId int, notificationId int) {
+	updateOwn(userId, notificationId, map[string]interface{}{"archived_at": nil})
+}
+
+// DeleteOwn deletes a notification of the user
+func DeleteOwn(userId int, notificationId int) {
+	result := database.DB.Where("id = ? AND user_id = ?", notificationId, userId).Delete(&Notifications{})
+	if result.Error != nil {
+		panic(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		panic(middlewares.GormError{Code: http.StatusNotFound, Message: "Message not found", IsGorm: true})
+	}
+}
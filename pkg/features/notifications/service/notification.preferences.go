@@ -0,0 +1,65 @@
+package notificationservice
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	notificatonstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/notifications/struct"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+)
+
+// Channels each user wants besides the inbox, everything off until the user turns it on
+type NotificationPreferences struct {
+	UserId        int    `gorm:"primaryKey;autoIncrement:false"`
+	Email         bool   `json:"email"`
+	Webhook       bool   `json:"webhook"`
+	WebhookURL    string `json:"webhook_url"`
+	WebhookSecret string `json:"webhook_secret"` // signs the webhooks, only shown to the user
+}
+
+func findPreferences(preferences *NotificationPreferences, userId int) {
+	if err := database.DB.Where(NotificationPreferences{UserId: userId}).FirstOrInit(preferences).Error; err != nil {
+		panic(err)
+	}
+}
+
+// FindPreferences returns the preferences of the user, the defaults when never saved
+func FindPreferences(userId int) NotificationPreferences {
+	var preferences NotificationPreferences
+	findPreferences(&preferences, userId)
+	return preferences
+}
+
+// UpdatePreferences saves the channels of the user, the webhook secret is created with the
+// first webhook and kept after, unless it is rotated
+func UpdatePreferences(userId int, body *notificatonstruct.NotificationPreferences) NotificationPreferences {
+	var preferences NotificationPreferences
+	findPreferences(&preferences, userId)
+
+	if body.Webhook {
+		address, err := url.Parse(body.WebhookURL)
+		if err != nil || address.Host == "" || (address.Scheme != "https" && !(address.Scheme == "http" && allowPrivateWebhooks())) {
+			panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "The webhook needs an https address", IsGorm: true})
+		}
+	}
+
+	preferences.UserId = userId
+	preferences.Email = body.Email
+	preferences.Webhook = body.Webhook
+	preferences.WebhookURL = body.WebhookURL
+	if preferences.WebhookSecret == "" || body.RotateSecret {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(err)
+		}
+		preferences.WebhookSecret = hex.EncodeToString(secret)
+	}
+
+	if err := database.DB.Save(&preferences).Error; err != nil {
+		panic(err)
+	}
+	return preferences
+}
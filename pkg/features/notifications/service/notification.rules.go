@@ -0,0 +1,239 @@
+package notificationservice
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	"github.com/Gamequic/LivePreviewBackend/pkg/events"
+	notificatonstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/notifications/struct"
+	pieceservice "github.com/Gamequic/LivePreviewBackend/pkg/features/pieces/service"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+/*
+	Rules turn the events of the bus into notifications. A rule picks the event type, the
+	message with placeholders like {public_id} or {patient} taken from the data of the event,
+	and the recipients: users of some profiles, users linked to the hospital of the record
+	and users linked to its doctor. Profile recipients outside the global scope only get it
+	when the record is inside their scope. Whoever caused the event is not notified.
+*/
+
+type NotificationRules struct {
+	gorm.Model
+	EventType  string `gorm:"index;not null"`
+	Message    string `gorm:"not null"`
+	ProfileIDs string `json:"-"` // ids separated by commas
+	ToHospital bool   // users linked to the hospital of the record
+	ToDoctor   bool   // users linked to the doctor of the record
+	Enabled    bool
+	Profiles   []uint `gorm:"-" json:"ProfileIDs"`
+}
+
+// Rules created on an empty table
+var defaultRules = []NotificationRules{
+	{EventType: pieceservice.EventPieceStatusChanged, Message: "The piece {public_id} of {patient} is now {status}", ToHospital: true, ToDoctor: true, Enabled: true},
+	{EventType: pieceservice.EventPieceReportSigned, Message: "The report of the piece {public_id} of {patient} is signed", ToHospital: true, ToDoctor: true, Enabled: true},
+}
+
+// EventTypes is every event a rule can listen to
+func EventTypes() []string {
+	return pieceservice.EventTypes
+}
+
+func validEventType(eventType string) bool {
+	for _, known := range EventTypes() {
+		if known == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *NotificationRules) loadProfiles() {
+	r.Profiles = []uint{}
+	for _, value := range strings.Split(r.ProfileIDs, ",") {
+		if id, err := strconv.Atoi(value); err == nil {
+			r.Profiles = append(r.Profiles, uint(id))
+		}
+	}
+}
+
+// initRules seeds the default rules and listens to the bus
+func initRules() {
+	var count int64
+	database.DB.Model(&NotificationRules{}).Count(&count)
+	if count == 0 {
+		rules := append([]NotificationRules{}, defaultRules...)
+		if err := database.DB.Create(&rules).Error; err != nil {
+			Logger.Error(fmt.Sprint("Failed to create default notification rules:", err))
+		}
+	}
+
+	events.SubscribeAll(applyRules)
+}
+
+// applyRules notifies the recipients of every enabled rule of the event
+func applyRules(event events.Event) {
+	var rules []NotificationRules
+	if err := database.DB.Where("event_type = ? AND enabled = ?", event.Type, true).Find(&rules).Error; err != nil {
+		Logger.Error("Error loading notification rules", zap.String("event", event.Type), zap.Error(err))
+		return
+	}
+
+	for i := range rules {
+		rules[i].loadProfiles()
+		userIds := ruleRecipients(&rules[i], event)
+		if len(userIds) == 0 {
+			continue
+		}
+
+		message := render(rules[i].Message, event.Data)
+		notifications := make([]Notifications, len(userIds))
+		for j, userId := range userIds {
+			notifications[j] = Notifications{UserId: userId, Message: message}
+		}
+		if err := database.DB.Omit("User").CreateInBatches(&notifications, broadcastBatch).Error; err != nil {
+			Logger.Error("Error creating notifications of rule", zap.Uint("rule", rules[i].ID), zap.Error(err))
+			continue
+		}
+		publishInBatches(notifications)
+		dispatch(notifications, event.Type, event.Data)
+
+		Logger.Info(fmt.Sprintf("Rule %d of %s notified %d users", rules[i].ID, event.Type, len(userIds)))
+	}
+}
+
+// ruleRecipients are the active users the rule targets for the event
+func ruleRecipients(rule *NotificationRules, event events.Event) []int {
+	linkedToHospital := "users.id IN (SELECT user_id FROM user_hospitals WHERE hospital_id = ?)"
+	linkedToDoctor := "users.id IN (SELECT user_id FROM user_doctors WHERE doctor_id = ?)"
+
+	conditions := []string{}
+	args := []interface{}{}
+	if rule.ToHospital && event.HospitalID != 0 {
+		conditions = append(conditions, linkedToHospital)
+		args = append(args, event.HospitalID)
+	}
+	if rule.ToDoctor && event.DoctorID != 0 {
+		conditions = append(conditions, linkedToDoctor)
+		args = append(args, event.DoctorID)
+	}
+	if len(rule.Profiles) > 0 {
+		// The lab staff always, the rest only when the record is theirs
+		conditions = append(conditions, `(
+			users.id IN (SELECT user_id FROM user_profiles WHERE profile_id IN ?) AND (
+				users.id IN (
+					SELECT user_profiles.user_id FROM user_profiles
+					JOIN profile_permissions ON profile_permissions.profile_id = user_profiles.profile_id
+					WHERE profile_permissions.permission IN ?
+				) OR `+linkedToHospital+` OR `+linkedToDoctor+`
+			)
+		)`)
+		args = append(args, rule.Profiles, []string{permissions.ScopeGlobal, permissions.All}, event.HospitalID, event.DoctorID)
+	}
+	if len(conditions) == 0 {
+		return nil
+	}
+
+	var userIds []int
+	err := database.DB.Table("users").
+		Where("users.deleted_at IS NULL AND users.deactivated_at IS NULL AND users.id <> ?", event.ActorID).
+		Where("("+strings.Join(conditions, " OR ")+")", args...).
+		Order("users.id").
+		Pluck("users.id", &userIds).Error
+	if err != nil {
+		Logger.Error("Error finding recipients of rule", zap.Uint("rule", rule.ID), zap.Error(err))
+		return nil
+	}
+	return userIds
+}
+
+// render replaces the placeholders of the message with the data of the event
+func render(message string, data map[string]interface{}) string {
+	pairs := make([]string, 0, len(data)*2)
+	for key, value := range data {
+		text := fmt.Sprint(value)
+		if number, ok := value.(float64); ok {
+			text = strconv.FormatFloat(number, 'f', 2, 64)
+		}
+		pairs = append(pairs, "{"+key+"}", text)
+	}
+	return strings.NewReplacer(pairs...).Replace(message)
+}
+
+// CRUD of the rules
+
+func FindRules(rules *[]NotificationRules) int {
+	if err := database.DB.Order("event_type, id").Find(rules).Error; err != nil {
+		panic(err)
+	}
+	for i := range *rules {
+		(*rules)[i].loadProfiles()
+	}
+	return http.StatusOK
+}
+
+func ruleFromBody(rule *NotificationRules, body *notificatonstruct.NotificationRule) {
+	if !validEventType(body.EventType) {
+		panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Unknown event type", IsGorm: true})
+	}
+	if !body.ToHospital && !body.ToDoctor && len(body.ProfileIDs) == 0 {
+		panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Choose some profiles, the hospital or the doctor", IsGorm: true})
+	}
+
+	ids := make([]string, len(body.ProfileIDs))
+	for i, id := range body.ProfileIDs {
+		ids[i] = strconv.Itoa(int(id))
+	}
+
+	rule.EventType = body.EventType
+	rule.Message = body.Message
+	rule.ProfileIDs = strings.Join(ids, ",")
+	rule.ToHospital = body.ToHospital
+	rule.ToDoctor = body.ToDoctor
+	rule.Enabled = body.Enabled == nil || *body.Enabled
+}
+
+func CreateRule(rule *NotificationRules, body *notificatonstruct.NotificationRule) int {
+	ruleFromBody(rule, body)
+	if err := database.DB.Create(rule).Error; err != nil {
+		panic(err)
+	}
+	rule.loadProfiles()
+	return http.StatusCreated
+}
+
+func findRule(rule *NotificationRules, id uint) {
+	if err := database.DB.First(rule, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			panic(middlewares.GormError{Code: http.StatusNotFound, Message: "Rule not found", IsGorm: true})
+		}
+		panic(err)
+	}
+}
+
+func UpdateRule(rule *NotificationRules, id uint, body *notificatonstruct.NotificationRule) int {
+	findRule(rule, id)
+	ruleFromBody(rule, body)
+	if err := database.DB.Save(rule).Error; err != nil {
+		panic(err)
+	}
+	rule.loadProfiles()
+	return http.StatusOK
+}
+
+func DeleteRule(id uint) {
+	var rule NotificationRules
+	findRule(&rule, id)
+	if err := database.DB.Delete(&rule).Error; err != nil {
+		panic(err)
+	}
+}
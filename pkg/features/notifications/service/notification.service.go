@@ -2,18 +2,19 @@ package notificationservice
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/Gamequic/LivePreviewBackend/pkg/database"
 	userservice "github.com/Gamequic/LivePreviewBackend/pkg/features/users/service"
+	"github.com/Gamequic/LivePreviewBackend/pkg/scope"
+	"github.com/Gamequic/LivePreviewBackend/pkg/session"
 	"github.com/Gamequic/LivePreviewBackend/utils"
 	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 
+	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
@@ -23,19 +24,28 @@ var Logger *zap.Logger
 // Update Users struct to use UserProfile
 type Notifications struct {
 	gorm.Model
-	UserId  int               `gorm:"not null"`
-	Message string            `gorm:"not null"`
-	Seen    bool              `gorm:"default:false"`
-	User    userservice.Users `gorm:"foreignKey:UserId;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+	UserId      int               `gorm:"not null;index"`
+	Message     string            `gorm:"not null"`
+	Seen        bool              `gorm:"default:false"`
+	SeenAt      *time.Time        `json:",omitempty"`
+	ArchivedAt  *time.Time        `json:",omitempty"` // hidden from the inbox
+	SenderId    *int              `json:",omitempty"` // nil when the system sends it
+	BroadcastId *uint             `gorm:"index" json:",omitempty"`
+	User        userservice.Users `gorm:"foreignKey:UserId;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
 }
 
 // Initialize the user service
 func InitNotificationsService() {
 	Logger = utils.NewLogger()
-	err := database.DB.AutoMigrate(&Notifications{})
+	err := database.DB.AutoMigrate(&Notifications{}, &NotificationBroadcasts{}, &NotificationRules{},
+		&NotificationPreferences{}, &NotificationDeliveries{}, &NotificationTemplates{})
 	if err != nil {
 		Logger.Error(fmt.Sprint("Failed to migrate database:", err))
 	}
+
+	initRules()
+	initChannels()
+	startDeliveryWorker()
 }
 
 // CRUD Operations
@@ -51,8 +61,17 @@ func FindOne(notification *Notifications, id int) error {
 	return nil
 }
 
-func Find(notification *[]Notifications) int {
-	if err := database.DB.Find(notification).Error; err != nil {
+// Find returns the notifications of the caller, the lab staff ask for another user with userId
+func Find(notification *[]Notifications, sc scope.Scope, userId int) int {
+	if userId == 0 {
+		userId = sc.UserID
+	}
+	if userId != sc.UserID && !sc.Global {
+		panic(middlewares.GormError{Code: http.StatusForbidden, Message: "You can only see your own notifications", IsGorm: true})
+	}
+	query := database.DB.Where("user_id = ?", userId)
+
+	if err := query.Find(notification).Error; err != nil {
 		panic(middlewares.GormError{
 			Code:    http.StatusInternalServerError,
 			Message: "Error retrieving notifications",
@@ -63,18 +82,28 @@ func Find(notification *[]Notifications) int {
 	return http.StatusOK
 }
 
-func MarkAsSeen(notificationId int) int {
+func MarkAsSeen(notificationId int, sc scope.Scope) int {
 	var notification Notifications
 	FindOne(&notification, notificationId)
+	if !sc.Global && notification.UserId != sc.UserID {
+		panic(middlewares.GormError{Code: 404, Message: "Message not found", IsGorm: true})
+	}
 
+	now := time.Now()
 	notification.Seen = true
+	notification.SeenAt = &now
 	database.DB.Save(&notification)
 
 	return http.StatusOK
 }
 
-func Create(notification *Notifications, userId int) int {
+// Create stores the notification and publishes it to the channel of its user, senderId is
+// the user that sends it, 0 for the notifications of the system
+func Create(notification *Notifications, senderId int) int {
 	notification.Seen = false
+	if senderId != 0 {
+		notification.SenderId = &senderId
+	}
 
 	// Create the notification on the database
 	if err := database.DB.Create(notification).Error; err != nil {
@@ -86,104 +115,83 @@ func Create(notification *Notifications, userId int) int {
 	}
 
 	// Publish the notification to the user on redis
-	ctx := context.Background()
-	channel := "user_notifications:" + strconv.Itoa(userId)
-
-	payload, err := json.Marshal(notification)
-	if err != nil {
-		Logger.Error("Failed to serialize payload", zap.Error(err))
-		panic(middlewares.GormError{Code: 500, Message: "Failed to serialize payload", IsGorm: false})
-	}
-
-	if err := database.RedisClient.Publish(ctx, channel, payload).Err(); err != nil {
+	if err := publish(context.Background(), []Notifications{*notification}); err != nil {
 		Logger.Error("Failed to publish notification to Redis", zap.Error(err))
 		panic(middlewares.GormError{Code: 500, Message: "Failed to publish notification to Redis", IsGorm: false})
 	}
 
-	Logger.Info(fmt.Sprintf("Notification sent to user %d", userId))
+	// Copies by email or webhook for the users that want them
+	dispatch([]Notifications{*notification}, "", nil)
+
+	Logger.Info(fmt.Sprintf("Notification sent by user %d to user %d", senderId, notification.UserId))
 	return http.StatusCreated
 }
 
+// Heartbeat of the event streams, the sockets use the one of middlewares
+const pingInterval = middlewares.WebSocketPingInterval
+
+// NotificationWebSocketEndpoint streams the notifications of the authenticated user, the
+// channel comes from the token and never from the request. With last_id the notifications
+// sent after it are delivered first
 func NotificationWebSocketEndpoint(w http.ResponseWriter, r *http.Request) {
-	userId := r.URL.Query().Get("userID")
+	lastId := r.URL.Query().Get("last_id")
+	if lastId != "" && !ValidStreamID(lastId) {
+		http.Error(w, "Invalid last_id", http.StatusBadRequest)
+		return
+	}
 
-	conn, err := utils.Upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		Logger.Error(fmt.Sprintf("No se pudo actualizar a WebSocket: %v", err))
+	conn, claims := middlewares.UpgradeAuthenticated(w, r, 5*time.Second)
+	if conn == nil {
+		Logger.Info("User not valid for notifications")
 		return
 	}
 	defer conn.Close()
 
-	// Timeout for discont the client
-	timeoutDuration := 5 * time.Second
-	timeout := time.NewTimer(timeoutDuration)
-	defer timeout.Stop()
-
-	// Validate if the userId can hear notifications
-	firstMessage := true
-
-	// variables for auth
-	// Variables para autenticación
-	var (
-		mu            sync.Mutex
-		authenticated bool
-	)
-
-	go func() {
-		for {
-			_, message, err := conn.ReadMessage()
-			if firstMessage {
-				firstMessage = false
-				userID := middlewares.ValidateUser(string(message))
-				if userID == -1 {
-					Logger.Info("User not valid for notifications")
-					conn.Close()
-					return
-				} else {
-					Logger.Info(fmt.Sprintf("User %v connected in notifications", userID))
-
-					// Lock to modify authenticated safely
-					mu.Lock()
-					authenticated = true
-					mu.Unlock()
-				}
-			}
-			if err != nil {
-				Logger.Info(fmt.Sprintf("Client desconection from notifications: %v", err))
-				return
-			}
-		}
-	}()
+	// Old clients still send userID, it has to be their own
+	if userId := r.URL.Query().Get("userID"); userId != "" && userId != strconv.Itoa(claims.Id) {
+		Logger.Warn(fmt.Sprintf("User %d tried to listen the notifications of user %s", claims.Id, userId))
+		middlewares.CloseWebSocket(conn, websocket.ClosePolicyViolation, "userID does not match the token")
+		return
+	}
 
-	ctx := context.Background()
-	channel := "user_notifications:" + userId
+	Logger.Info(fmt.Sprintf("User %v connected in notifications", claims.Id))
 
-	pubsub := database.RedisClient.Subscribe(ctx, channel)
-	defer pubsub.Close()
+	// Close the socket if the session is revoked
+	untrack := session.TrackConnection(claims.Id, claims.SessionID, func() { conn.Close() })
+	defer untrack()
 
-	ch := pubsub.Channel()
+	feed, err := openFeed(context.Background(), claims.Id, lastId)
+	if err != nil {
+		Logger.Error("Error subscribing to notifications", zap.Error(err))
+		middlewares.CloseWebSocket(conn, websocket.CloseInternalServerErr, "Try again later")
+		return
+	}
+	defer feed.Close()
+	write := func(message LiveMessage) error { return conn.WriteJSON(message) }
+
+	closed := middlewares.WatchWebSocket(conn)
+
+	if !feed.Deliver(write) {
+		return
+	}
+
+	ch := feed.Wake()
+	ping := time.NewTicker(middlewares.WebSocketPingInterval)
+	defer ping.Stop()
 
 	for {
 		select {
-		case msg := <-ch:
-			if err := conn.WriteJSON(msg.Payload); err != nil {
-				Logger.Error(fmt.Sprint("Error writing to WebSocket ", err))
-				conn.Close()
+		case <-ch:
+			if !feed.Deliver(write) {
 				return
 			}
-		// Disconect the client if the timeout is reached
-		case <-timeout.C:
-			mu.Lock()
-			// Disconnect the client if it is not authenticated
-			if !authenticated {
-				Logger.Info(fmt.Sprintf("Cliente %s desconectado por falta de autenticación", userId))
-				conn.Close()
-				mu.Unlock()
+		case <-ping.C:
+			if !middlewares.PingWebSocket(conn) {
 				return
 			}
-			mu.Unlock()
+		case err := <-closed:
+			Logger.Info(fmt.Sprintf("Client desconection from notifications: %v", err))
+			return
 		}
 	}
-
-	return
 }
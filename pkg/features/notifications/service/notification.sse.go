@@ -0,0 +1,109 @@
+package notificationservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	authstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/struct"
+	"github.com/Gamequic/LivePreviewBackend/pkg/session"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Server-Sent Events, for the clients behind proxies that drop the WebSocket upgrade. It is a
+	plain GET authenticated like any other route and sends the same messages as the socket:
+
+		id: <stream id>
+		event: notification
+		data: {"type":"notification","id":"<stream id>","notification":{...}}
+
+	The browser sends the last id back on Last-Event-ID when it reconnects, last_id in the
+	query does the same for the first connection.
+*/
+
+// Wait the browser uses before reconnecting
+const sseRetry = 5 * time.Second
+
+// NotificationEventsEndpoint streams the notifications of the authenticated user as events
+func NotificationEventsEndpoint(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middlewares.UserKey).(*authstruct.TokenStruct)
+
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = r.URL.Query().Get("last_id")
+	}
+	if lastId != "" && !ValidStreamID(lastId) {
+		panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Invalid Last-Event-ID", IsGorm: true})
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// End the stream if the session is revoked
+	untrack := session.TrackConnection(claims.Id, claims.SessionID, cancel)
+	defer untrack()
+
+	feed, err := openFeed(ctx, claims.Id, lastId)
+	if err != nil {
+		Logger.Error("Error subscribing to notifications", zap.Error(err))
+		panic(middlewares.GormError{Code: http.StatusServiceUnavailable, Message: "Try again later", IsGorm: true})
+	}
+	defer feed.Close()
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx would hold the events in its buffer
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	if err := controller.Flush(); err != nil {
+		Logger.Error("Streaming is not supported by the connection", zap.Error(err))
+		return
+	}
+
+	Logger.Info(fmt.Sprintf("User %v connected in notifications events", claims.Id))
+
+	write := func(message LiveMessage) error {
+		payload, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", message.ID, message.Type, payload); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+
+	if !feed.Deliver(write) {
+		return
+	}
+
+	ch := feed.Wake()
+	// A comment now and then keeps the proxies from closing an idle connection
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ch:
+			if !feed.Deliver(write) {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := controller.Flush(); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
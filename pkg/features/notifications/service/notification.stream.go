@@ -0,0 +1,168 @@
+package notificationservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+/*
+	Live delivery. Every notification is appended to a Redis Stream per user, the stream id
+	is what the client remembers. On reconnection the client sends the last id it got and
+	receives everything after it. Pub/Sub is only the wake up signal of the open sockets,
+	so no socket holds a blocking read on the pool.
+*/
+
+const (
+	streamMaxLen = 500                // notifications kept per user for the replay
+	streamTTL    = 7 * 24 * time.Hour // streams of users without news are removed
+	replayBatch  = 100
+)
+
+var streamIDPattern = regexp.MustCompile(`^[0-9]+(-[0-9]+)?$`)
+
+// LiveMessage is what the socket sends for each notification
+type LiveMessage struct {
+	Type         string          `json:"type"`
+	ID           string          `json:"id"` // send it back as last_id when reconnecting
+	Notification json.RawMessage `json:"notification"`
+}
+
+func streamKey(userId int) string {
+	return "notifications_stream:" + strconv.Itoa(userId)
+}
+
+func channelOf(userId int) string {
+	return "user_notifications:" + strconv.Itoa(userId)
+}
+
+// ValidStreamID tells if the last id sent by a client can be used
+func ValidStreamID(id string) bool {
+	return streamIDPattern.MatchString(id)
+}
+
+// publish appends the notifications to the stream of their users and wakes up their sockets,
+// everything goes in one pipeline so a broadcast is a single round trip per batch
+func publish(ctx context.Context, notifications []Notifications) error {
+	_, err := database.RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range notifications {
+			payload, err := json.Marshal(notifications[i])
+			if err != nil {
+				return err
+			}
+
+			key := streamKey(notifications[i].UserId)
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: key,
+				MaxLen: streamMaxLen,
+				Approx: true,
+				Values: map[string]interface{}{"notification": payload},
+			})
+			pipe.Expire(ctx, key, streamTTL)
+			pipe.Publish(ctx, channelOf(notifications[i].UserId), "new")
+		}
+		return nil
+	})
+	return err
+}
+
+// lastStreamID is the id of the newest notification of the user, "0" when there is none
+func lastStreamID(ctx context.Context, userId int) (string, error) {
+	messages, err := database.RedisClient.XRevRangeN(ctx, streamKey(userId), "+", "-", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(messages) == 0 {
+		return "0", nil
+	}
+	return messages[0].ID, nil
+}
+
+// readAfter returns the notifications of the user after the id, oldest first
+func readAfter(ctx context.Context, userId int, lastId string) ([]LiveMessage, error) {
+	result := []LiveMessage{}
+	for {
+		streams, err := database.RedisClient.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{streamKey(userId), lastId},
+			Count:   replayBatch,
+			Block:   -1, // never blocks, the socket waits on Pub/Sub
+		}).Result()
+		if err == redis.Nil {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+
+		messages := streams[0].Messages
+		for _, message := range messages {
+			payload, _ := message.Values["notification"].(string)
+			result = append(result, LiveMessage{Type: "notification", ID: message.ID, Notification: json.RawMessage(payload)})
+			lastId = message.ID
+		}
+		if len(messages) < replayBatch {
+			return result, nil
+		}
+	}
+}
+
+// liveFeed is the subscription of one client to the notifications of its user, the WebSocket
+// and the SSE endpoint only differ in how they write each message
+type liveFeed struct {
+	ctx    context.Context
+	userId int
+	lastId string
+	pubsub *redis.PubSub
+}
+
+// openFeed subscribes before reading the stream, so nothing falls between the replay and the
+// live feed. Without lastId only what comes after the connection is sent
+func openFeed(ctx context.Context, userId int, lastId string) (*liveFeed, error) {
+	pubsub := database.RedisClient.Subscribe(ctx, channelOf(userId))
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	if lastId == "" {
+		var err error
+		if lastId, err = lastStreamID(ctx, userId); err != nil {
+			pubsub.Close()
+			return nil, err
+		}
+	}
+	return &liveFeed{ctx: ctx, userId: userId, lastId: lastId, pubsub: pubsub}, nil
+}
+
+// Wake receives a value every time something is published to the user
+func (f *liveFeed) Wake() <-chan *redis.Message {
+	return f.pubsub.Channel()
+}
+
+// Deliver writes what is after the last id sent, false when the client can not be written
+func (f *liveFeed) Deliver(write func(LiveMessage) error) bool {
+	messages, err := readAfter(f.ctx, f.userId, f.lastId)
+	if err != nil {
+		Logger.Error("Error reading notifications stream", zap.Error(err))
+	}
+	for _, message := range messages {
+		if err := write(message); err != nil {
+			Logger.Info(fmt.Sprintf("Error writing notifications of user %d: %v", f.userId, err))
+			return false
+		}
+		f.lastId = message.ID
+	}
+	return true
+}
+
+func (f *liveFeed) Close() {
+	f.pubsub.Close()
+}
@@ -4,3 +4,46 @@ type NotificationCreate struct {
 	UserId  int    `validate:"required"`
 	Message string `validate:"required"`
 }
+
+// Filters and page of the inbox, read from the query string
+type InboxQuery struct {
+	Page     int  // from 1
+	Limit    int  // 20 by default, 100 at most
+	Unread   bool // only the unseen ones
+	Archived bool // the archived ones instead of the inbox
+}
+
+// Message for many users, at least one target is needed, the targets add up
+type NotificationBroadcast struct {
+	Message     string `validate:"required" json:"message"`
+	All         bool   `json:"all"` // every active user
+	ProfileIDs  []uint `validate:"omitempty,dive,min=1" json:"profile_ids"`
+	HospitalIDs []uint `validate:"omitempty,dive,min=1" json:"hospital_ids"`
+}
+
+// Rule that turns an event into notifications, at least one kind of recipient is needed
+type NotificationRule struct {
+	EventType  string `validate:"required" json:"event_type"`
+	Message    string `validate:"required" json:"message"` // placeholders like {public_id} come from the event
+	ProfileIDs []uint `validate:"omitempty,dive,min=1" json:"profile_ids"`
+	ToHospital bool   `json:"to_hospital"`
+	ToDoctor   bool   `json:"to_doctor"`
+	Enabled    *bool  `json:"enabled"` // true when missing
+}
+
+// Channels of the user besides the inbox
+type NotificationPreferences struct {
+	Email        bool   `json:"email"`
+	Webhook      bool   `json:"webhook"`
+	WebhookURL   string `validate:"required_if=Webhook true,omitempty,url,max=500" json:"webhook_url"`
+	RotateSecret bool   `json:"rotate_secret"` // a new secret for the webhook signature
+}
+
+// Message of a channel for an event, {message} is the text of the notification and the
+// rest of the placeholders come from the event
+type NotificationTemplate struct {
+	Channel   string `validate:"required,oneof=email webhook" json:"channel"`
+	EventType string `json:"event_type"` // empty for the notifications without an event
+	Subject   string `validate:"max=200" json:"subject"`
+	Body      string `validate:"required" json:"body"`
+}
@@ -6,6 +6,7 @@ import (
 	"strconv"
 
 	pieceservice "github.com/Gamequic/LivePreviewBackend/pkg/features/pieces/service"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
 	"github.com/Gamequic/LivePreviewBackend/utils"
 	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 
@@ -26,7 +27,7 @@ func create(w http.ResponseWriter, r *http.Request) {
 	*/
 	json.NewDecoder(r.Body).Decode(&pieces)
 
-	pieceservice.Create(&pieces)
+	pieceservice.Create(&pieces, middlewares.UserScope(r))
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(pieces)
 }
@@ -34,7 +35,7 @@ func create(w http.ResponseWriter, r *http.Request) {
 func find(w http.ResponseWriter, r *http.Request) {
 	//Service
 	var pieces []pieceservice.Pieces
-	var httpsResponse int = pieceservice.Find(&pieces)
+	var httpsResponse int = pieceservice.Find(&pieces, middlewares.UserScope(r))
 
 	//Https response
 	w.WriteHeader(httpsResponse)
@@ -48,7 +49,7 @@ func findOne(w http.ResponseWriter, r *http.Request) {
 		panic(middlewares.GormError{Code: 400, Message: err.Error(), IsGorm: true})
 	}
 	var pieces pieceservice.Pieces
-	var httpsResponse int = pieceservice.FindOne(&pieces, uint(id))
+	var httpsResponse int = pieceservice.FindOne(&pieces, uint(id), middlewares.UserScope(r))
 	w.WriteHeader(httpsResponse)
 	json.NewEncoder(w).Encode(pieces)
 }
@@ -89,7 +90,7 @@ func findWithFilters(w http.ResponseWriter, r *http.Request) {
 		"endDeliveredAt":   query.Get("endDeliveredAt"),
 	}
 
-	results := pieceservice.FindByFilters(filters)
+	results := pieceservice.FindByFilters(filters, middlewares.UserScope(r))
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -105,11 +106,22 @@ func update(w http.ResponseWriter, r *http.Request) {
 	id := uint(idInt)
 	var piece pieceservice.Pieces
 	json.NewDecoder(r.Body).Decode(&piece)
-	pieceservice.Update(&piece, id)
+	pieceservice.Update(&piece, id, middlewares.UserScope(r))
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(piece)
 }
 
+func signReport(w http.ResponseWriter, r *http.Request) {
+	idInt, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		panic(middlewares.GormError{Code: 400, Message: err.Error(), IsGorm: true})
+	}
+	var piece pieceservice.Pieces
+	var httpsResponse int = pieceservice.SignReport(&piece, uint(idInt), middlewares.UserScope(r))
+	w.WriteHeader(httpsResponse)
+	json.NewEncoder(w).Encode(piece)
+}
+
 func delete(w http.ResponseWriter, r *http.Request) {
 	logger = utils.NewLogger()
 	vars := mux.Vars(r)
@@ -119,7 +131,7 @@ func delete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	pieceservice.Delete(id)
+	pieceservice.Delete(id, middlewares.UserScope(r))
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode("Piece deleted successfully")
 }
@@ -132,20 +144,30 @@ func RegisterSubRoutes(router *mux.Router) {
 
 	// ValidatorHandler - Update
 	usersUpdateValidator := piecesRouter.NewRoute().Subrouter()
+	usersUpdateValidator.Use(middlewares.RequirePermission(permissions.PiecesWrite))
 	// usersUpdateValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(userstruct.UpdateUser{})))
 	// usersUpdateValidator.Use(middlewares.AuthHandler)
 	usersUpdateValidator.HandleFunc("/{id}", update).Methods("PUT")
 
+	// Signing is not editing, only who signs the reports can do it
+	piecesSign := piecesRouter.NewRoute().Subrouter()
+	piecesSign.Use(middlewares.RequirePermission(permissions.PiecesSign))
+	piecesSign.HandleFunc("/{id}/sign", signReport).Methods("PUT")
+
 	// ValidatorHandler - Create
 	piecesCreateValidator := piecesRouter.NewRoute().Subrouter()
+	piecesCreateValidator.Use(middlewares.RequirePermission(permissions.PiecesWrite))
 	// piecesCreateValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(userstruct.CreateUser{})))
 	piecesCreateValidator.HandleFunc("/", create).Methods("POST")
 
 	// Protected functions
 	piecesProtected := piecesRouter.NewRoute().Subrouter()
-	// piecesProtected.Use(middlewares.ProfilesHandler([]uint{1, 2, 4}))
+	piecesProtected.Use(middlewares.RequirePermission(permissions.PiecesRead))
 	piecesProtected.HandleFunc("/", find).Methods("GET")
 	piecesProtected.HandleFunc("/search", findWithFilters).Methods("GET")
 	piecesProtected.HandleFunc("/{id}", findOne).Methods("GET")
-	piecesProtected.HandleFunc("/{id}", delete).Methods("DELETE")
+
+	piecesDelete := piecesRouter.NewRoute().Subrouter()
+	piecesDelete.Use(middlewares.RequirePermission(permissions.PiecesWrite))
+	piecesDelete.HandleFunc("/{id}", delete).Methods("DELETE")
 }
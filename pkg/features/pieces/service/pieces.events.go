@@ -0,0 +1,100 @@
+package pieceservice
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	"github.com/Gamequic/LivePreviewBackend/pkg/events"
+	"github.com/Gamequic/LivePreviewBackend/pkg/scope"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+)
+
+// Events of the lifecycle of a piece, the notification rules listen to them
+const (
+	EventPieceCreated         = "piece.created"
+	EventPieceStatusChanged   = "piece.status_changed"
+	EventPiecePaymentReceived = "piece.payment_received"
+	EventPieceReportSigned    = "piece.report_signed"
+)
+
+// EventTypes is every event of the pieces
+var EventTypes = []string{EventPieceCreated, EventPieceStatusChanged, EventPiecePaymentReceived, EventPieceReportSigned}
+
+// Status of a piece, it comes from its dates
+const (
+	StatusReceived  = "received"
+	StatusDelivered = "delivered"
+)
+
+func statusOf(piece *Pieces) string {
+	if !piece.DeliveredAt.IsZero() {
+		return StatusDelivered
+	}
+	return StatusReceived
+}
+
+// emit publishes an event of the piece, the names of the hospital and doctor go on the data
+func emit(eventType string, piece *Pieces, hospitalName string, doctorName string, actorId int, extra map[string]interface{}) {
+	data := map[string]interface{}{
+		"piece_id":  piece.ID,
+		"public_id": piece.PublicId,
+		"patient":   piece.PatientName,
+		"hospital":  hospitalName,
+		"doctor":    doctorName,
+		"status":    statusOf(piece),
+	}
+	for key, value := range extra {
+		data[key] = value
+	}
+
+	events.Publish(events.Event{
+		Type:       eventType,
+		ActorID:    actorId,
+		HospitalID: piece.HospitalID,
+		DoctorID:   piece.DoctorID,
+		Data:       data,
+	})
+}
+
+// emitChanges compares the piece before and after an update
+func emitChanges(before *Pieces, after *Pieces, hospitalName string, doctorName string, actorId int) {
+	if statusOf(before) != statusOf(after) {
+		emit(EventPieceStatusChanged, after, hospitalName, doctorName, actorId, map[string]interface{}{
+			"previous_status": statusOf(before),
+		})
+	}
+	if after.PricePaid > before.PricePaid || (after.IsPaid && !before.IsPaid) {
+		emit(EventPiecePaymentReceived, after, hospitalName, doctorName, actorId, map[string]interface{}{
+			"amount": after.PricePaid - before.PricePaid,
+			"paid":   after.PricePaid,
+			"total":  after.PriceTotal,
+		})
+	}
+}
+
+// SignReport marks the report of the piece as signed by the user, it is signed once
+func SignReport(piece *Pieces, id uint, sc scope.Scope) int {
+	FindOne(piece, id, sc)
+	if piece.ReportSignedAt != nil {
+		panic(middlewares.GormError{Code: http.StatusConflict, Message: "The report is already signed", IsGorm: true})
+	}
+
+	now := time.Now()
+	signedBy := uint(sc.UserID)
+	result := database.DB.Model(&Pieces{}).
+		Where("id = ? AND report_signed_at IS NULL", id).
+		Updates(map[string]interface{}{"report_signed_at": now, "report_signed_by": signedBy})
+	if result.Error != nil {
+		panic(result.Error)
+	}
+	// Someone else signed it after it was read
+	if result.RowsAffected == 0 {
+		panic(middlewares.GormError{Code: http.StatusConflict, Message: "The report is already signed", IsGorm: true})
+	}
+	piece.ReportSignedAt = &now
+	piece.ReportSignedBy = &signedBy
+
+	emit(EventPieceReportSigned, piece, piece.Hospital.Name, piece.Doctor.Name, sc.UserID, nil)
+	return http.StatusOK
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -11,6 +12,7 @@ import (
 	"github.com/Gamequic/LivePreviewBackend/pkg/database"
 	doctorservice "github.com/Gamequic/LivePreviewBackend/pkg/features/doctor/service"
 	hospitalservice "github.com/Gamequic/LivePreviewBackend/pkg/features/hospital/service"
+	"github.com/Gamequic/LivePreviewBackend/pkg/scope"
 	"github.com/Gamequic/LivePreviewBackend/utils"
 	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 
@@ -47,6 +49,9 @@ type Pieces struct {
 	ReceivedAt   time.Time `json:"receivedAt"`
 	DeliveredAt  time.Time `json:"deliveredAt"`
 	Description  string    `json:"Description"`
+
+	ReportSignedAt *time.Time `json:"reportSignedAt"`
+	ReportSignedBy *uint      `json:"reportSignedBy"` // user that signed the report
 }
 
 // Initialize the user service
@@ -60,7 +65,67 @@ func InitPiecesService() {
 
 // CRUD Operations
 
-func Create(piece *Pieces) int {
+// checkScope rejects pieces of hospitals and doctors that do not exist or are outside the
+// scope. It runs before anything is created, so only a global scope creates hospitals or
+// doctors. A hospital is inside the scope when it is linked to the user or works with one of
+// their doctors, the same goes for a doctor
+func checkScope(piece *Pieces, sc scope.Scope) {
+	if sc.Global {
+		return
+	}
+
+	var hospital hospitalservice.Hospital
+	var doctor doctorservice.Doctor
+	for _, err := range []error{
+		database.DB.Where("name = ?", piece.Hospital.Name).First(&hospital).Error,
+		database.DB.Where("name = ?", piece.Doctor.Name).First(&doctor).Error,
+	} {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			panic(middlewares.GormError{
+				Code:    http.StatusForbidden,
+				Message: "Only the lab can create hospitals or doctors",
+				IsGorm:  true,
+			})
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if !hospitalInScope(hospital.ID, sc) || !doctorInScope(doctor.ID, sc) {
+		panic(middlewares.GormError{
+			Code:    http.StatusForbidden,
+			Message: "The hospital or doctor is outside your scope",
+			IsGorm:  true,
+		})
+	}
+}
+
+func hospitalInScope(hospitalId uint, sc scope.Scope) bool {
+	if slices.Contains(sc.HospitalIDs, hospitalId) {
+		return true
+	}
+	var count int64
+	database.DB.Table("doctor_hospitals").
+		Where("hospital_id = ? AND doctor_id IN ?", hospitalId, sc.DoctorIDsOrNone()).
+		Count(&count)
+	return count > 0
+}
+
+func doctorInScope(doctorId uint, sc scope.Scope) bool {
+	if slices.Contains(sc.DoctorIDs, doctorId) {
+		return true
+	}
+	var count int64
+	database.DB.Table("doctor_hospitals").
+		Where("doctor_id = ? AND hospital_id IN ?", doctorId, sc.HospitalIDsOrNone()).
+		Count(&count)
+	return count > 0
+}
+
+func Create(piece *Pieces, sc scope.Scope) int {
+	checkScope(piece, sc)
+
 	// Verifica que el PublicId sea único
 	var count int64
 	database.DB.Model(&Pieces{}).Where("public_id = ?", piece.PublicId).Count(&count)
@@ -118,11 +183,12 @@ func Create(piece *Pieces) int {
 		panic(err)
 	}
 
+	emit(EventPieceCreated, piece, hospital.Name, doctor.Name, sc.UserID, nil)
 	return http.StatusOK
 }
 
-func Find(Piece *[]Pieces) int {
-	if err := database.DB.Find(Piece).Error; err != nil {
+func Find(Piece *[]Pieces, sc scope.Scope) int {
+	if err := sc.Apply(database.DB, "hospital_id", "doctor_id").Find(Piece).Error; err != nil {
 		panic(middlewares.GormError{
 			Code:    http.StatusInternalServerError,
 			Message: "Error retrieving pieces",
@@ -132,9 +198,9 @@ func Find(Piece *[]Pieces) int {
 	return http.StatusOK
 }
 
-func FindOne(Piece *Pieces, id uint) int {
-	// Query con preloads para traer relaciones
-	if err := database.DB.Model(&Pieces{}).
+func FindOne(Piece *Pieces, id uint, sc scope.Scope) int {
+	// Query con preloads para traer relaciones, fuera del scope es como si no existiera
+	if err := sc.Apply(database.DB.Model(&Pieces{}), "pieces.hospital_id", "pieces.doctor_id").
 		Preload("Doctor").
 		Preload("Hospital").
 		First(Piece, id).Error; err != nil {
@@ -155,7 +221,7 @@ func FindOne(Piece *Pieces, id uint) int {
 	return http.StatusOK
 }
 
-func FindByFilters(filters map[string]string) []Pieces {
+func FindByFilters(filters map[string]string, sc scope.Scope) []Pieces {
 	loc, _ := time.LoadLocation("America/Mexico_City")
 	dateLayout := "2006-01-02"
 
@@ -165,6 +231,7 @@ func FindByFilters(filters map[string]string) []Pieces {
 		Preload("Doctor").
 		Preload("Hospital").
 		Order("created_at DESC")
+	query = sc.Apply(query, "pieces.hospital_id", "pieces.doctor_id")
 
 	// --- FILTROS BÁSICOS ---
 	if publicIdStr := filters["publicId"]; publicIdStr != "" && publicIdStr != "null" {
@@ -257,10 +324,11 @@ func FindByFilters(filters map[string]string) []Pieces {
 	return results
 }
 
-func Update(piece *Pieces, id uint) int {
-	// 1. Verificar que la pieza exista
+func Update(piece *Pieces, id uint, sc scope.Scope) int {
+	// 1. Verificar que la pieza exista y este dentro del scope, tambien la nueva
+	checkScope(piece, sc)
 	var existingPiece Pieces
-	if err := database.DB.First(&existingPiece, id).Error; err != nil {
+	if err := sc.Apply(database.DB, "hospital_id", "doctor_id").First(&existingPiece, id).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			panic(middlewares.GormError{
 				Code:    http.StatusNotFound,
@@ -344,19 +412,21 @@ func Update(piece *Pieces, id uint) int {
 		"delivered_at":   piece.DeliveredAt,
 	}
 
+	previousPiece := existingPiece
 	if err := database.DB.Model(&existingPiece).Updates(updates).Error; err != nil {
 		panic(err)
 	}
 
+	emitChanges(&previousPiece, piece, hospital.Name, doctor.Name, sc.UserID)
 	return http.StatusOK
 }
 
-func Delete(id int) {
+func Delete(id int, sc scope.Scope) {
 	Logger = utils.NewLogger()
 
 	// No autorize deleting no existing pieces
 	var previousPiece Pieces
-	FindOne(&previousPiece, uint(id))
+	FindOne(&previousPiece, uint(id), sc)
 
 	if err := database.DB.Delete(&Pieces{}, id).Error; err != nil {
 		panic(err)
@@ -2,11 +2,16 @@ package profiles
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"reflect"
 	"strconv"
 
+	authstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/struct"
 	profileservice "github.com/Gamequic/LivePreviewBackend/pkg/features/profiles/service"
 	profilestruct "github.com/Gamequic/LivePreviewBackend/pkg/features/profiles/struct"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
@@ -43,13 +48,17 @@ func updateProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var profile profilestruct.Profile
-	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+	var body profilestruct.UpdateProfile
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
 
-	if err := profileservice.Update(&profile, id); err != nil {
+	if err := profileservice.Update(&body, id, holder(r)); err != nil {
+		if errors.Is(err, profileservice.ErrCannotGrant) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
@@ -97,7 +106,11 @@ func deleteProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := profileservice.Delete(id); err != nil {
+	if err := profileservice.Delete(id, holder(r)); err != nil {
+		if errors.Is(err, profileservice.ErrCannotGrant) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
@@ -108,14 +121,67 @@ func deleteProfile(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func getPermissionsCatalog(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(append([]string{permissions.All}, permissions.Catalog...))
+}
+
+func updateProfilePermissions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid profile ID", http.StatusBadRequest)
+		return
+	}
+
+	var body profilestruct.UpdatePermissions
+	json.NewDecoder(r.Body).Decode(&body)
+
+	granted, err := profileservice.UpdatePermissions(id, body.Permissions, holder(r))
+	if err != nil {
+		if errors.Is(err, profileservice.ErrCannotGrant) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err.Error() == "profile not found" {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":     "Permissions updated successfully",
+		"permissions": granted,
+	})
+}
+
+// holder are the profiles of the user of the request
+func holder(r *http.Request) []string {
+	return r.Context().Value(middlewares.UserKey).(*authstruct.TokenStruct).Profiles
+}
+
 // Register function
 
 func RegisterSubRoutes(router *mux.Router) {
 	profilesRouter := router.PathPrefix("/profiles").Subrouter()
-
-	profilesRouter.HandleFunc("/", createProfile).Methods("POST")
-	profilesRouter.HandleFunc("/{id}", updateProfile).Methods("PATCH")
-	profilesRouter.HandleFunc("/{id}", getProfile).Methods("GET")
-	profilesRouter.HandleFunc("/", getProfiles).Methods("GET")
-	profilesRouter.HandleFunc("/{id}", deleteProfile).Methods("DELETE")
+	profilesRouter.Use(middlewares.AuthHandler)
+
+	profilesRead := profilesRouter.NewRoute().Subrouter()
+	profilesRead.Use(middlewares.RequirePermission(permissions.ProfilesRead))
+	profilesRead.HandleFunc("/permissions", getPermissionsCatalog).Methods("GET")
+	profilesRead.HandleFunc("/{id}", getProfile).Methods("GET")
+	profilesRead.HandleFunc("/", getProfiles).Methods("GET")
+
+	profilesWrite := profilesRouter.NewRoute().Subrouter()
+	profilesWrite.Use(middlewares.RequirePermission(permissions.ProfilesWrite))
+	profilesWrite.HandleFunc("/", createProfile).Methods("POST")
+	profilesWrite.HandleFunc("/{id}", updateProfile).Methods("PATCH")
+	profilesWrite.HandleFunc("/{id}", deleteProfile).Methods("DELETE")
+
+	permissionsValidator := profilesWrite.NewRoute().Subrouter()
+	permissionsValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(profilestruct.UpdatePermissions{})))
+	permissionsValidator.HandleFunc("/{id}/permissions", updateProfilePermissions).Methods("PUT")
 }
@@ -2,12 +2,14 @@ package profileservice
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/Gamequic/LivePreviewBackend/pkg/database"
 	profilestruct "github.com/Gamequic/LivePreviewBackend/pkg/features/profiles/struct"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
 	"github.com/Gamequic/LivePreviewBackend/utils"
 
 	"go.uber.org/zap"
@@ -16,6 +18,8 @@ import (
 
 var Logger *zap.Logger
 
+var ErrCannotGrant = errors.New("you can not grant permissions you do not hold")
+
 // Initialize the profile service
 func InitProfileService() {
 	Logger = utils.NewLogger()
@@ -78,7 +82,7 @@ func Create(profile *profilestruct.Profile) error {
 	return nil
 }
 
-func Update(profile *profilestruct.Profile, id int) error {
+func Update(body *profilestruct.UpdateProfile, id int, holder []string) error {
 	var existingProfile profilestruct.Profile
 	if err := database.DB.First(&existingProfile, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
@@ -86,15 +90,26 @@ func Update(profile *profilestruct.Profile, id int) error {
 		}
 		return err
 	}
+	if !canChange(id, holder) {
+		return ErrCannotGrant
+	}
 
-	profile.ID = id
-	profile.UpdatedAt = time.Now()
-
-	if err := database.DB.Save(profile).Error; err != nil {
-		return err
+	values := map[string]interface{}{}
+	if body.Name != nil {
+		values["name"] = *body.Name
+	}
+	// Turning it off would let the users of the profile in without the second factor
+	if body.RequireTwoFactor != nil {
+		if !permissions.Has(holder, permissions.AuthAdmin) {
+			return ErrCannotGrant
+		}
+		values["require_two_factor"] = *body.RequireTwoFactor
+	}
+	if len(values) == 0 {
+		return nil
 	}
 
-	return nil
+	return database.DB.Model(&existingProfile).Updates(values).Error
 }
 
 func FindOne(profile *profilestruct.Profile, id int) error {
@@ -104,6 +119,7 @@ func FindOne(profile *profilestruct.Profile, id int) error {
 		}
 		return err
 	}
+	profile.Permissions = permissions.OfProfile(profile.ID)
 	return nil
 }
 
@@ -111,10 +127,61 @@ func Find(profiles *[]profilestruct.Profile) error {
 	if err := database.DB.Find(profiles).Error; err != nil {
 		return err
 	}
+	for i := range *profiles {
+		(*profiles)[i].Permissions = permissions.OfProfile((*profiles)[i].ID)
+	}
 	return nil
 }
 
-func Delete(id int) error {
+// canChange tells if the holder has every permission the profile already grants, as users
+// are only managed by who holds their permissions
+func canChange(id int, holder []string) bool {
+	for _, permission := range permissions.OfProfile(id) {
+		if !permissions.Has(holder, permission) {
+			return false
+		}
+	}
+	return true
+}
+
+// UpdatePermissions replaces the permissions of the profile, they must exist on the catalog and
+// be held by the holder. "*" is only given by init.sql
+func UpdatePermissions(id int, requested []string, holder []string) ([]string, error) {
+	var profile profilestruct.Profile
+	if err := database.DB.First(&profile, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.New("profile not found")
+		}
+		return nil, err
+	}
+	if !canChange(id, holder) {
+		return nil, ErrCannotGrant
+	}
+
+	unique := map[string]bool{}
+	list := []string{}
+	for _, permission := range requested {
+		if !permissions.IsValid(permission) {
+			return nil, fmt.Errorf("unknown permission %s", permission)
+		}
+		if permission == permissions.All || !permissions.Has(holder, permission) {
+			return nil, ErrCannotGrant
+		}
+		if !unique[permission] {
+			unique[permission] = true
+			list = append(list, permission)
+		}
+	}
+
+	if err := permissions.Set(id, list); err != nil {
+		return nil, err
+	}
+
+	Logger.Info(fmt.Sprintf("Permissions of profile %s updated: %v", profile.Name, list))
+	return permissions.OfProfile(id), nil
+}
+
+func Delete(id int, holder []string) error {
 	var profile profilestruct.Profile
 	if err := database.DB.First(&profile, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
@@ -122,10 +189,13 @@ func Delete(id int) error {
 		}
 		return err
 	}
+	if !canChange(id, holder) {
+		return ErrCannotGrant
+	}
 
 	if err := database.DB.Delete(&profile).Error; err != nil {
 		return err
 	}
 
-	return nil
+	return permissions.Set(id, nil)
 }
@@ -3,8 +3,20 @@ package profilestruct
 import "time"
 
 type Profile struct {
-	ID        int       `json:"id" gorm:"primaryKey"`
-	Name      string    `json:"name" gorm:"unique;not null"`
-	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime:true;default:CURRENT_TIMESTAMP"`
-	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime:true;default:CURRENT_TIMESTAMP"`
+	ID               int       `json:"id" gorm:"primaryKey"`
+	Name             string    `json:"name" gorm:"unique;not null"`
+	RequireTwoFactor bool      `json:"require_two_factor" gorm:"default:false"` // users with this profile can not log in without 2FA
+	Permissions      []string  `json:"permissions" gorm:"-"`                    // loaded from profile_permissions
+	CreatedAt        time.Time `json:"created_at" gorm:"autoCreateTime:true;default:CURRENT_TIMESTAMP"`
+	UpdatedAt        time.Time `json:"updated_at" gorm:"autoUpdateTime:true;default:CURRENT_TIMESTAMP"`
+}
+
+// Fields of PATCH /profiles/{id}, the ones not sent are kept
+type UpdateProfile struct {
+	Name             *string `json:"name"`
+	RequireTwoFactor *bool   `json:"require_two_factor"`
+}
+
+type UpdatePermissions struct {
+	Permissions []string `validate:"required,dive,required" json:"permissions"`
 }
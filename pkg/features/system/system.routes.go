@@ -6,6 +6,8 @@ import (
 	"time"
 
 	systemservice "github.com/Gamequic/LivePreviewBackend/pkg/features/system/service"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
+	"github.com/Gamequic/LivePreviewBackend/pkg/session"
 	"github.com/Gamequic/LivePreviewBackend/utils"
 	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 	"github.com/gorilla/mux"
@@ -31,13 +33,21 @@ func SystemMetricsHandler(w http.ResponseWriter, r *http.Request) {
 			if firstMessage {
 				firstMessage = false
 				clientActive <- true
-				userID := middlewares.ValidateUser(string(message))
-				if userID == -1 {
+				claims := middlewares.ValidateUserClaims(string(message))
+				if claims == nil {
 					Logger.Info("User not valid for system metrics")
 					conn.Close()
 					return
+				} else if !permissions.Has(claims.Profiles, permissions.SystemRead) {
+					Logger.Info(fmt.Sprintf("User %v without permission for system metrics", claims.Id))
+					conn.Close()
+					return
 				} else {
-					Logger.Info(fmt.Sprintf("User %v connected in system metrics", userID))
+					Logger.Info(fmt.Sprintf("User %v connected in system metrics", claims.Id))
+
+					// Close the socket if the session is revoked
+					untrack := session.TrackConnection(claims.Id, claims.SessionID, func() { conn.Close() })
+					defer untrack()
 				}
 			}
 			if err != nil {
@@ -0,0 +1,163 @@
+package userservice
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
+	"github.com/Gamequic/LivePreviewBackend/pkg/session"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+
+	"gorm.io/gorm"
+)
+
+/*
+	Management of other accounts. Nobody manages their own account from here and nobody
+	can hand out or take away permissions they do not hold, so an admin can not make
+	themselves root nor deactivate a root user.
+*/
+
+// Actor is the user doing the change, the profiles come as in the token
+type Actor struct {
+	ID       uint
+	Profiles []string
+}
+
+// canGrant tells if the actor holds every permission of the profiles
+func (a Actor) canGrant(profileIds []uint) bool {
+	for _, profileId := range profileIds {
+		for _, permission := range permissions.OfProfile(int(profileId)) {
+			if !permissions.Has(a.Profiles, permission) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkManage panics when the actor can not manage the target user
+func (a Actor) checkManage(target *Users) {
+	if target.ID == a.ID {
+		panic(middlewares.GormError{Code: http.StatusForbidden, Message: "You can not manage your own account", IsGorm: true})
+	}
+	if !a.canGrant(target.Profiles) {
+		panic(middlewares.GormError{Code: http.StatusForbidden, Message: "The user has permissions you do not hold", IsGorm: true})
+	}
+}
+
+// AssignProfiles replaces the profiles of another user
+func AssignProfiles(userId uint, profileIds []uint, actor Actor) Users {
+	var user Users
+	FindOne(&user, userId)
+	actor.checkManage(&user)
+
+	unique := uniqueIds(profileIds)
+	var count int64
+	database.DB.Table("profiles").Where("id IN ?", profileIds).Count(&count)
+	if int(count) != len(unique) {
+		panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Some profiles do not exist", IsGorm: true})
+	}
+	if !actor.canGrant(profileIds) {
+		panic(middlewares.GormError{Code: http.StatusForbidden, Message: "You can not grant permissions you do not hold", IsGorm: true})
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM user_profiles WHERE user_id = ?", userId).Error; err != nil {
+			return err
+		}
+		for profileId := range unique {
+			if err := tx.Exec("INSERT INTO user_profiles (user_id, profile_id) VALUES (?, ?)", userId, profileId).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// The tokens carry the profiles, the user logs in again to get the new ones
+	if err := session.RemoveAllSessions(int(userId)); err != nil {
+		Logger.Error(fmt.Sprint("Error removing sessions of user ", userId, ": ", err))
+	}
+
+	user.Profiles = loadUserProfiles(userId)
+	Logger.Info(fmt.Sprintf("User %d assigned profiles %v to user %d", actor.ID, user.Profiles, userId))
+	return user
+}
+
+// Deactivate blocks the login of another user and closes their sessions
+func Deactivate(userId uint, actor Actor) Users {
+	var user Users
+	FindOne(&user, userId)
+	actor.checkManage(&user)
+
+	if user.DeactivatedAt == nil {
+		now := time.Now()
+		if err := database.DB.Model(&user).Update("deactivated_at", &now).Error; err != nil {
+			panic(err)
+		}
+		user.DeactivatedAt = &now
+	}
+
+	if err := session.RemoveAllSessions(int(userId)); err != nil {
+		Logger.Error(fmt.Sprint("Error removing sessions of user ", userId, ": ", err))
+	}
+
+	Logger.Info(fmt.Sprintf("User %d deactivated user %d", actor.ID, userId))
+	return user
+}
+
+// Reactivate lets a deactivated user log in again
+func Reactivate(userId uint, actor Actor) Users {
+	var user Users
+	FindOne(&user, userId)
+	actor.checkManage(&user)
+
+	if err := database.DB.Model(&user).Update("deactivated_at", nil).Error; err != nil {
+		panic(err)
+	}
+	user.DeactivatedAt = nil
+
+	Logger.Info(fmt.Sprintf("User %d reactivated user %d", actor.ID, userId))
+	return user
+}
+
+// Restore brings back a deleted user with their profiles
+func Restore(userId uint, actor Actor) Users {
+	var user Users
+	if err := database.DB.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", userId).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			panic(middlewares.GormError{Code: http.StatusNotFound, Message: "Deleted user not found", IsGorm: true})
+		}
+		panic(err)
+	}
+	user.Profiles = loadUserProfiles(user.ID)
+	actor.checkManage(&user)
+
+	if err := database.DB.Unscoped().Model(&user).Update("deleted_at", nil).Error; err != nil {
+		panic(err)
+	}
+
+	user.Password = ""
+	user.DeletedAt = gorm.DeletedAt{}
+	Logger.Info(fmt.Sprintf("User %d restored user %d", actor.ID, userId))
+	return user
+}
+
+// DeleteBy deletes another user and closes their sessions
+func DeleteBy(userId uint, actor Actor) {
+	var user Users
+	FindOne(&user, userId)
+	actor.checkManage(&user)
+
+	Delete(int(userId))
+
+	if err := session.RemoveAllSessions(int(userId)); err != nil {
+		Logger.Error(fmt.Sprint("Error removing sessions of user ", userId, ": ", err))
+	}
+	Logger.Info(fmt.Sprintf("User %d deleted user %d", actor.ID, userId))
+}
@@ -0,0 +1,220 @@
+package userservice
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	userstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/users/struct"
+	"github.com/Gamequic/LivePreviewBackend/pkg/mailer"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+/*
+	Invitations are created by an administrator with the profiles of the new user,
+	the invited person chooses the password when accepting and the email is verified by then.
+	Only the sha256 of the token is stored.
+*/
+
+type UserInvitations struct {
+	gorm.Model
+	Email      string     `gorm:"index;not null" json:"email"`
+	Name       string     `json:"name"`
+	TokenHash  string     `gorm:"uniqueIndex;not null" json:"-"`
+	Profiles   string     `gorm:"not null" json:"-"` // profile ids separated by commas
+	InvitedBy  uint       `gorm:"not null" json:"invited_by"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at"`
+	AcceptedBy *uint      `json:"accepted_by"` // id of the user created
+	ProfileIDs []uint     `gorm:"-" json:"profiles"`
+}
+
+func invitationTTL() time.Duration {
+	hours, err := strconv.Atoi(os.Getenv("INVITATION_TTL_HOURS"))
+	if err != nil || hours <= 0 {
+		hours = 72
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+func hashInvitationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (i *UserInvitations) loadProfileIDs() {
+	i.ProfileIDs = []uint{}
+	for _, value := range strings.Split(i.Profiles, ",") {
+		if id, err := strconv.Atoi(value); err == nil {
+			i.ProfileIDs = append(i.ProfileIDs, uint(id))
+		}
+	}
+}
+
+// Invite emails an invitation, a pending invitation to the same email is replaced
+func Invite(body *userstruct.CreateInvitation, actor Actor) UserInvitations {
+	email := strings.ToLower(strings.TrimSpace(body.Email))
+
+	var count int64
+	database.DB.Model(&Users{}).Where("LOWER(email) = ?", email).Count(&count)
+	if count > 0 {
+		panic(middlewares.GormError{Code: http.StatusConflict, Message: "Email is on use", IsGorm: true})
+	}
+
+	var profiles int64
+	database.DB.Table("profiles").Where("id IN ?", body.Profiles).Count(&profiles)
+	if int(profiles) != len(uniqueIds(body.Profiles)) {
+		panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Some profiles do not exist", IsGorm: true})
+	}
+	// The invited user gets the profiles on accepting, the same rule as assigning them
+	if !actor.canGrant(body.Profiles) {
+		panic(middlewares.GormError{Code: http.StatusForbidden, Message: "You can not grant permissions you do not hold", IsGorm: true})
+	}
+
+	ids := make([]string, 0, len(body.Profiles))
+	for id := range uniqueIds(body.Profiles) {
+		ids = append(ids, strconv.Itoa(int(id)))
+	}
+
+	token := randomToken()
+	invitation := UserInvitations{
+		Email:     email,
+		Name:      body.Name,
+		TokenHash: hashInvitationToken(token),
+		Profiles:  strings.Join(ids, ","),
+		InvitedBy: actor.ID,
+		ExpiresAt: time.Now().Add(invitationTTL()),
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("email = ? AND accepted_at IS NULL", email).Delete(&UserInvitations{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&invitation).Error
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	link := fmt.Sprintf("%s/accept-invitation?token=%s", os.Getenv("FRONTEND_URL"), token)
+	go func() {
+		err := mailer.Send(mailer.Message{
+			To:      []string{email},
+			Subject: "You have been invited",
+			Text: fmt.Sprintf("Hi %s,\n\nYou have been invited to ArenasCRM. Use the next link to choose your password, it expires in %d hours:\n\n%s",
+				invitation.Name, int(invitationTTL().Hours()), link),
+		})
+		if err != nil {
+			Logger.Error("Error sending invitation", zap.String("email", email), zap.Error(err))
+		}
+	}()
+
+	Logger.Info(fmt.Sprintf("User %d invited %s with profiles %s", actor.ID, email, invitation.Profiles))
+	invitation.loadProfileIDs()
+	return invitation
+}
+
+// FindInvitations returns the invitations not accepted yet
+func FindInvitations(invitations *[]UserInvitations) int {
+	if err := database.DB.Where("accepted_at IS NULL").Order("created_at DESC").Find(invitations).Error; err != nil {
+		panic(err)
+	}
+	for i := range *invitations {
+		(*invitations)[i].loadProfileIDs()
+	}
+	return http.StatusOK
+}
+
+// RevokeInvitation deletes a pending invitation, the link stops working
+func RevokeInvitation(id uint) {
+	result := database.DB.Where("id = ? AND accepted_at IS NULL", id).Delete(&UserInvitations{})
+	if result.Error != nil {
+		panic(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		panic(middlewares.GormError{Code: http.StatusNotFound, Message: "Invitation not found", IsGorm: true})
+	}
+}
+
+func findPendingInvitation(tx *gorm.DB, token string) UserInvitations {
+	var invitation UserInvitations
+	err := tx.Where("token_hash = ? AND accepted_at IS NULL", hashInvitationToken(token)).First(&invitation).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Invalid or expired invitation", IsGorm: true})
+		}
+		panic(err)
+	}
+	if invitation.ExpiresAt.Before(time.Now()) {
+		panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Invalid or expired invitation", IsGorm: true})
+	}
+	return invitation
+}
+
+// GetInvitation shows the invitation of the token before accepting it
+func GetInvitation(token string) userstruct.InvitationInfo {
+	invitation := findPendingInvitation(database.DB, token)
+	return userstruct.InvitationInfo{
+		Email:     invitation.Email,
+		Name:      invitation.Name,
+		ExpiresAt: invitation.ExpiresAt,
+	}
+}
+
+// AcceptInvitation creates the user with the profiles of the invitation
+func AcceptInvitation(body *userstruct.AcceptInvitation) Users {
+	var user Users
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		invitation := findPendingInvitation(tx, body.Token)
+		invitation.loadProfileIDs()
+
+		name := body.Name
+		if name == "" {
+			name = invitation.Name
+		}
+		if len(name) < 3 {
+			panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Name is required", IsGorm: true})
+		}
+
+		now := time.Now()
+		user = Users{
+			Name:            name,
+			Email:           invitation.Email,
+			Password:        body.Password,
+			EmailVerifiedAt: &now,
+		}
+		if err := createUser(tx, &user, invitation.ProfileIDs); err != nil {
+			return err
+		}
+
+		// Accepted once, the token stops working
+		result := tx.Model(&invitation).
+			Where("accepted_at IS NULL").
+			Updates(map[string]interface{}{"accepted_at": now, "accepted_by": user.ID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("invitation already accepted")
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	user.Profiles = loadUserProfiles(user.ID)
+	Logger.Info(fmt.Sprintf("Invitation accepted by %s, user %d created", user.Email, user.ID))
+	return user
+}
@@ -0,0 +1,85 @@
+package userservice
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	"github.com/Gamequic/LivePreviewBackend/pkg/passwords"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// checkPassword panics when the password does not follow the policy
+func checkPassword(user *Users, password string) {
+	if err := passwords.Validate(password, user.Email, user.Name); err != nil {
+		var policyErr *passwords.Error
+		if errors.As(err, &policyErr) {
+			panic(middlewares.GormError{Code: http.StatusBadRequest, Message: policyErr.Error(), IsGorm: true})
+		}
+		panic(err)
+	}
+}
+
+// PasswordHash checks the new password of the user, who has to come with the current hash, and
+// returns its hash without saving it, so a one time token is only spent on a valid password
+func PasswordHash(user *Users, password string) string {
+	return newPasswordHash(user, user.Password, password)
+}
+
+// SetPassword saves a hash made by PasswordHash
+func SetPassword(user *Users, hash string) {
+	var changedAt time.Time
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		changedAt, err = savePassword(tx, user.ID, hash)
+		return err
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	user.Password = ""
+	user.PasswordChangedAt = &changedAt
+}
+
+// newPasswordHash checks the policy with the name and email of the user and the history, then
+// returns the hash to store. Nothing is written, so it runs before any other change
+func newPasswordHash(user *Users, currentHash string, password string) string {
+	checkPassword(user, password)
+
+	if bcrypt.CompareHashAndPassword([]byte(currentHash), []byte(password)) == nil || passwords.Reused(user.ID, password) {
+		panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Password was used recently, choose another one", IsGorm: true})
+	}
+
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return string(bytes)
+}
+
+// savePassword stores the hash and remembers it on the history, inside the transaction of the caller
+func savePassword(tx *gorm.DB, userId uint, hash string) (time.Time, error) {
+	now := time.Now()
+	err := tx.Model(&Users{}).Where("id = ?", userId).Updates(map[string]interface{}{
+		"password":            hash,
+		"password_changed_at": now,
+	}).Error
+	if err != nil {
+		return now, err
+	}
+	return now, passwords.Remember(tx, userId, hash)
+}
+
+// PasswordExpired tells if the user has to change the password before logging in
+func PasswordExpired(user *Users) bool {
+	changedAt := user.CreatedAt
+	if user.PasswordChangedAt != nil {
+		changedAt = *user.PasswordChangedAt
+	}
+	return passwords.Expired(changedAt)
+}
@@ -3,8 +3,12 @@ package userservice
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	userstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/users/struct"
+	"github.com/Gamequic/LivePreviewBackend/pkg/passwords"
+	"github.com/Gamequic/LivePreviewBackend/pkg/scope"
 	"github.com/Gamequic/LivePreviewBackend/utils"
 	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 
@@ -28,15 +32,30 @@ type Users struct {
 	Email    string `gorm:"unique;not null"`
 	Password string `gorm:"not null"`
 	Profiles []uint `gorm:"-"` // Not a database field
+
+	// Nil while a self registered user has not confirmed the email, they can not log in
+	EmailVerifiedAt *time.Time `json:",omitempty"`
+	// Set by an admin, the user can not log in until reactivated
+	DeactivatedAt *time.Time `json:",omitempty"`
+	// Used for the forced rotation, PASSWORD_MAX_AGE_DAYS
+	PasswordChangedAt *time.Time `json:"-"`
 }
 
 // Initialize the user service
 func InitUsersService() {
 	Logger = utils.NewLogger()
-	err := database.DB.AutoMigrate(&Users{})
+
+	// The users from before the verification are trusted
+	backfillVerified := database.DB.Migrator().HasTable(&Users{}) && !database.DB.Migrator().HasColumn(&Users{}, "EmailVerifiedAt")
+
+	err := database.DB.AutoMigrate(&Users{}, &UserInvitations{})
 	if err != nil {
 		Logger.Error(fmt.Sprint("Failed to migrate database:", err))
 	}
+
+	if backfillVerified {
+		database.DB.Exec("UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL")
+	}
 }
 
 // CRUD Operations
@@ -51,45 +70,72 @@ func loadUserProfiles(userID uint) []uint {
 	return profiles
 }
 
+// Guest profile, the one given to self registered users
+const defaultProfileID = 3
+
 func Create(user *Users) int {
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		return createUser(tx, user, []uint{defaultProfileID})
+	}); err != nil {
+		panic(err)
+	}
+
+	// Load profiles
+	user.Profiles = loadUserProfiles(user.ID)
+	return http.StatusOK
+}
+
+// createUser inserts the user with the given profiles inside a transaction
+func createUser(tx *gorm.DB, user *Users, profileIds []uint) error {
+	checkPassword(user, user.Password)
+
 	// Encrypt password
 	bytes, _ := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	user.Password = string(bytes)
+	now := time.Now()
+	user.PasswordChangedAt = &now
 
 	// Create users in DB
-	if err := database.DB.Create(user).Error; err != nil {
+	if err := tx.Create(user).Error; err != nil {
 		if err.Error() == `ERROR: duplicate key value violates unique constraint "uni_users_email" (SQLSTATE 23505)` {
 			panic(middlewares.GormError{Code: 409, Message: "Email is on use", IsGorm: true})
-		} else {
-			panic(err)
 		}
+		return err
 	}
 
-	// Assign default profile (ID 3 - guest)
-	err := database.DB.Exec(
-		"INSERT INTO user_profiles (user_id, profile_id) VALUES (?, ?)",
-		user.ID,
-		3, // guest profile ID
-	).Error
-	if err != nil {
-		panic(middlewares.GormError{
-			Code:    500,
-			Message: "Failed to assign default profile",
-			IsGorm:  true,
-		})
+	if err := passwords.Remember(tx, user.ID, user.Password); err != nil {
+		return err
+	}
+
+	for _, profileId := range profileIds {
+		err := tx.Exec(
+			"INSERT INTO user_profiles (user_id, profile_id) VALUES (?, ?)",
+			user.ID,
+			profileId,
+		).Error
+		if err != nil {
+			panic(middlewares.GormError{
+				Code:    500,
+				Message: "Failed to assign profiles",
+				IsGorm:  true,
+			})
+		}
 	}
 
 	// Exclude password from response
 	user.Password = ""
-
-	// Load profiles
-	user.Profiles = loadUserProfiles(user.ID)
-	return http.StatusOK
+	return nil
 }
 
-func Find(u *[]Users) int {
+func Find(u *[]Users, deleted bool) int {
+	query := database.DB
+	if deleted {
+		// Only the deleted ones, so they can be restored
+		query = query.Unscoped().Where("deleted_at IS NOT NULL")
+	}
+
 	// Find all users and select all fields except password
-	if err := database.DB.Select("id, name, email, created_at, updated_at, deleted_at").Find(u).Error; err != nil {
+	if err := query.Select("id, name, email, email_verified_at, deactivated_at, created_at, updated_at, deleted_at").Find(u).Error; err != nil {
 		panic(middlewares.GormError{
 			Code:    http.StatusInternalServerError,
 			Message: "Error retrieving users",
@@ -141,6 +187,7 @@ func FindByEmail(user *Users, email string) int {
 	return http.StatusOK
 }
 
+// Update edits the own account, the profiles are managed with AssignProfiles
 func Update(user *Users, userId uint) int {
 	// No autorize editing no existing users
 	var previousUsers Users
@@ -151,15 +198,26 @@ func Update(user *Users, userId uint) int {
 		panic(middlewares.GormError{Code: http.StatusNotAcceptable, Message: "Is not allow to modify others users", IsGorm: true})
 	}
 
-	// Encrypt password if is any
+	// The new password follows the policy with the new name and email, and is checked against
+	// the history before anything is written
+	hash := ""
 	if user.Password != "" {
-		bytes, _ := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-		user.Password = string(bytes)
-	} else {
-		user.Password = previousUsers.Password
+		hash = newPasswordHash(user, previousUsers.Password, user.Password)
 	}
 
-	if err := database.DB.Save(user).Error; err != nil {
+	// Only the fields the user can edit, the rest are kept. All or nothing
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&previousUsers).Select("name", "email").Updates(map[string]interface{}{
+			"name":  user.Name,
+			"email": user.Email,
+		}).Error
+		if err != nil || hash == "" {
+			return err
+		}
+		_, err = savePassword(tx, previousUsers.ID, hash)
+		return err
+	})
+	if err != nil {
 		if err.Error() == `ERROR: duplicate key value violates unique constraint "uni_users_email" (SQLSTATE 23505)` {
 			panic(middlewares.GormError{Code: 409, Message: "Email is on use", IsGorm: true})
 		} else {
@@ -167,21 +225,8 @@ func Update(user *Users, userId uint) int {
 		}
 	}
 
-	// Update profiles
-	database.DB.Exec("DELETE FROM user_profiles WHERE user_id = ?", userId)
-	for _, profileID := range user.Profiles {
-		database.DB.Exec(
-			"INSERT INTO user_profiles (user_id, profile_id) VALUES (?, ?)",
-			userId,
-			profileID,
-		)
-	}
-
 	// Exclude password from response
-	user.Password = ""
-
-	// Reload profiles
-	user.Profiles = loadUserProfiles(user.ID)
+	FindOne(user, userId)
 	return http.StatusOK
 }
 
@@ -196,3 +241,46 @@ func Delete(id int) {
 		panic(err)
 	}
 }
+
+// FindScope returns the hospitals and doctors linked to the user
+func FindScope(userId uint) userstruct.UserScope {
+	var user Users
+	FindOne(&user, userId)
+
+	hospitalIds, doctorIds := scope.Links(userId)
+	return userstruct.UserScope{HospitalIDs: hospitalIds, DoctorIDs: doctorIds}
+}
+
+// UpdateScope replaces the hospitals and doctors linked to the user
+func UpdateScope(userId uint, userScope *userstruct.UserScope) {
+	var user Users
+	FindOne(&user, userId)
+
+	var count int64
+	if len(userScope.HospitalIDs) > 0 {
+		database.DB.Table("hospitals").Where("id IN ? AND deleted_at IS NULL", userScope.HospitalIDs).Count(&count)
+		if int(count) != len(uniqueIds(userScope.HospitalIDs)) {
+			panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Some hospitals do not exist", IsGorm: true})
+		}
+	}
+	if len(userScope.DoctorIDs) > 0 {
+		database.DB.Table("doctors").Where("id IN ? AND deleted_at IS NULL", userScope.DoctorIDs).Count(&count)
+		if int(count) != len(uniqueIds(userScope.DoctorIDs)) {
+			panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Some doctors do not exist", IsGorm: true})
+		}
+	}
+
+	if err := scope.SetLinks(userId, userScope.HospitalIDs, userScope.DoctorIDs); err != nil {
+		panic(err)
+	}
+
+	Logger.Info(fmt.Sprintf("Scope of user %d updated, hospitals %v doctors %v", userId, userScope.HospitalIDs, userScope.DoctorIDs))
+}
+
+func uniqueIds(ids []uint) map[uint]bool {
+	unique := map[uint]bool{}
+	for _, id := range ids {
+		unique[id] = true
+	}
+	return unique
+}
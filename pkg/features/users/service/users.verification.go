@@ -0,0 +1,151 @@
+package userservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	"github.com/Gamequic/LivePreviewBackend/pkg/mailer"
+	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+/*
+	Self registration, SIGNUP_MODE chooses how it works
+	open    the account can be used right away
+	verify  the account can be used once the email is confirmed (default)
+	closed  only invited users get an account
+*/
+
+const (
+	SignupOpen   = "open"
+	SignupVerify = "verify"
+	SignupClosed = "closed"
+)
+
+// How long an email verification link can be used
+const EmailVerificationTTL = 24 * time.Hour
+
+func SignupMode() string {
+	switch mode := os.Getenv("SIGNUP_MODE"); mode {
+	case SignupOpen, SignupClosed:
+		return mode
+	default:
+		return SignupVerify
+	}
+}
+
+func randomToken() string {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// Register is the self registration, it follows SIGNUP_MODE
+func Register(user *Users) int {
+	mode := SignupMode()
+	if mode == SignupClosed {
+		panic(middlewares.GormError{Code: http.StatusForbidden, Message: "Sign up is disabled, ask an administrator for an invitation", IsGorm: true})
+	}
+
+	if mode == SignupOpen {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	} else {
+		user.EmailVerifiedAt = nil
+	}
+
+	Create(user)
+
+	if mode == SignupVerify {
+		if err := SendVerification(user); err != nil {
+			Logger.Error("Error sending email verification", zap.String("email", user.Email), zap.Error(err))
+		}
+	}
+
+	return http.StatusCreated
+}
+
+// SendVerification emails the confirmation link, only the last one sent works
+func SendVerification(user *Users) error {
+	token := randomToken()
+
+	ctx := context.Background()
+	userKey := "email_verify_user:" + strconv.Itoa(int(user.ID))
+	if previous, err := database.RedisClient.Get(ctx, userKey).Result(); err == nil {
+		database.RedisClient.Del(ctx, "email_verify:"+previous)
+	}
+
+	if err := database.RedisClient.Set(ctx, "email_verify:"+token, user.ID, EmailVerificationTTL).Err(); err != nil {
+		return err
+	}
+	database.RedisClient.Set(ctx, userKey, token, EmailVerificationTTL)
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", os.Getenv("FRONTEND_URL"), token)
+	name := user.Name
+	email := user.Email
+
+	// Sent in background, the response time must not depend on the email
+	go func() {
+		err := mailer.Send(mailer.Message{
+			To:      []string{email},
+			Subject: "Confirm your email",
+			Text: fmt.Sprintf("Hi %s,\n\nUse the next link to confirm your email, it expires in %d hours:\n\n%s\n\nIf you did not create an account you can ignore this email.",
+				name, int(EmailVerificationTTL.Hours()), link),
+		})
+		if err != nil {
+			Logger.Error("Error sending email verification", zap.String("email", email), zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+// VerifyEmail confirms the email of the token, the link works once
+func VerifyEmail(token string) {
+	ctx := context.Background()
+
+	userId, err := database.RedisClient.GetDel(ctx, "email_verify:"+token).Int()
+	if err != nil {
+		panic(middlewares.GormError{Code: http.StatusBadRequest, Message: "Invalid or expired verification link", IsGorm: true})
+	}
+	database.RedisClient.Del(ctx, "email_verify_user:"+strconv.Itoa(userId))
+
+	now := time.Now()
+	result := database.DB.Model(&Users{}).
+		Where("id = ? AND email_verified_at IS NULL", userId).
+		Update("email_verified_at", &now)
+	if result.Error != nil {
+		panic(result.Error)
+	}
+
+	Logger.Info(fmt.Sprintf("User %d verified the email", userId))
+}
+
+// ResendVerification sends the link again, unknown or verified emails are ignored silently
+func ResendVerification(email string) error {
+	var user Users
+	if err := database.DB.Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	if user.EmailVerifiedAt != nil {
+		return nil
+	}
+
+	return SendVerification(&user)
+}
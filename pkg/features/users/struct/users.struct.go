@@ -1,5 +1,7 @@
 package userstruct
 
+import "time"
+
 type CreateUser struct {
 	Name     string `validate:"required,min=3"`
 	Email    string `validate:"required,email"`
@@ -11,4 +13,45 @@ type UpdateUser struct {
 	Name     string `validate:"required,min=3"`
 	Email    string `validate:"required,email"`
 	Password string `validate:"omitempty,min=8"`
+	// Needed to change the email or the password, the code only when 2FA is enabled
+	CurrentPassword string
+	Code            string
+}
+
+// Hospitals and doctors whose records the user can see, empty on lab staff
+type UserScope struct {
+	HospitalIDs []uint `validate:"omitempty,dive,min=1" json:"hospital_ids"`
+	DoctorIDs   []uint `validate:"omitempty,dive,min=1" json:"doctor_ids"`
+}
+
+// Profiles given by an admin to another user
+type AssignProfiles struct {
+	Profiles []uint `validate:"required,min=1,dive,min=1" json:"profiles"`
+}
+
+type CreateInvitation struct {
+	Email    string `validate:"required,email" json:"email"`
+	Name     string `validate:"omitempty,min=3" json:"name"`
+	Profiles []uint `validate:"required,min=1,dive,min=1" json:"profiles"`
+}
+
+type AcceptInvitation struct {
+	Token    string `validate:"required" json:"token"`
+	Name     string `validate:"omitempty,min=3" json:"name"` // replaces the one given on the invitation
+	Password string `validate:"required,min=8" json:"password"`
+}
+
+// What the invited person sees before accepting
+type InvitationInfo struct {
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type VerifyEmail struct {
+	Token string `validate:"required" json:"token"`
+}
+
+type ResendVerification struct {
+	Email string `validate:"required,email" json:"email"`
 }
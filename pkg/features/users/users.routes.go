@@ -5,9 +5,13 @@ import (
 	"net/http"
 	"reflect"
 	"strconv"
+	"strings"
 
+	authservice "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/service"
+	authstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/struct"
 	userservice "github.com/Gamequic/LivePreviewBackend/pkg/features/users/service"
 	userstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/users/struct"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
 	"github.com/Gamequic/LivePreviewBackend/utils"
 	"github.com/Gamequic/LivePreviewBackend/utils/middlewares"
 
@@ -28,7 +32,7 @@ func create(w http.ResponseWriter, r *http.Request) {
 	*/
 	json.NewDecoder(r.Body).Decode(&user)
 
-	userservice.Create(&user)
+	userservice.Register(&user)
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(user)
 }
@@ -36,7 +40,7 @@ func create(w http.ResponseWriter, r *http.Request) {
 func find(w http.ResponseWriter, r *http.Request) {
 	//Service
 	var users []userservice.Users
-	var httpsResponse int = userservice.Find(&users)
+	var httpsResponse int = userservice.Find(&users, r.URL.Query().Get("deleted") == "true")
 
 	//Https response
 	w.WriteHeader(httpsResponse)
@@ -71,12 +75,21 @@ func findMe(w http.ResponseWriter, r *http.Request) {
 }
 
 func update(w http.ResponseWriter, r *http.Request) {
-	var user userservice.Users
-	json.NewDecoder(r.Body).Decode(&user)
+	var body userstruct.UpdateUser
+	json.NewDecoder(r.Body).Decode(&body)
 
 	userIdInterface := r.Context().Value(middlewares.UserIDKey)
 	userId := uint(userIdInterface.(int))
 
+	// The credentials are only changed by who knows them, a stolen token is not enough
+	var current userservice.Users
+	userservice.FindOne(&current, userId)
+	if body.Password != "" || !strings.EqualFold(body.Email, current.Email) {
+		authservice.VerifyIdentity(userId, body.CurrentPassword, body.Code, utils.ClientIP(r))
+	}
+
+	user := userservice.Users{Name: body.Name, Email: body.Email, Password: body.Password}
+	user.ID = uint(body.ID)
 	userservice.Update(&user, userId)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(user)
@@ -91,11 +104,158 @@ func delete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	userservice.Delete(id)
+	userservice.DeleteBy(uint(id), actor(r))
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode("User deleted successfully")
 }
 
+// Admin management
+
+// actor is the user of the request
+func actor(r *http.Request) userservice.Actor {
+	userClaims := r.Context().Value(middlewares.UserKey).(*authstruct.TokenStruct)
+	return userservice.Actor{ID: uint(userClaims.Id), Profiles: userClaims.Profiles}
+}
+
+func assignProfiles(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		panic(middlewares.GormError{Code: 400, Message: err.Error(), IsGorm: true})
+	}
+
+	var body userstruct.AssignProfiles
+	json.NewDecoder(r.Body).Decode(&body)
+
+	var user userservice.Users = userservice.AssignProfiles(uint(id), body.Profiles, actor(r))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user)
+}
+
+func deactivate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		panic(middlewares.GormError{Code: 400, Message: err.Error(), IsGorm: true})
+	}
+
+	var user userservice.Users = userservice.Deactivate(uint(id), actor(r))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user)
+}
+
+func reactivate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		panic(middlewares.GormError{Code: 400, Message: err.Error(), IsGorm: true})
+	}
+
+	var user userservice.Users = userservice.Reactivate(uint(id), actor(r))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user)
+}
+
+func restore(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		panic(middlewares.GormError{Code: 400, Message: err.Error(), IsGorm: true})
+	}
+
+	var user userservice.Users = userservice.Restore(uint(id), actor(r))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user)
+}
+
+func findScope(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		panic(middlewares.GormError{Code: 400, Message: err.Error(), IsGorm: true})
+	}
+
+	var userScope userstruct.UserScope = userservice.FindScope(uint(id))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(userScope)
+}
+
+func updateScope(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		panic(middlewares.GormError{Code: 400, Message: err.Error(), IsGorm: true})
+	}
+
+	var userScope userstruct.UserScope
+	json.NewDecoder(r.Body).Decode(&userScope)
+
+	userservice.UpdateScope(uint(id), &userScope)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(userScope)
+}
+
+// Email verification
+
+func verifyEmail(w http.ResponseWriter, r *http.Request) {
+	var body userstruct.VerifyEmail
+	json.NewDecoder(r.Body).Decode(&body)
+
+	userservice.VerifyEmail(body.Token)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Email verified successfully")
+}
+
+func resendVerification(w http.ResponseWriter, r *http.Request) {
+	var body userstruct.ResendVerification
+	json.NewDecoder(r.Body).Decode(&body)
+
+	if err := userservice.ResendVerification(body.Email); err != nil {
+		panic(err)
+	}
+	// Same answer whether the email exists or not
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("If the email is pending of verification a new link was sent")
+}
+
+// Invitations
+
+func createInvitation(w http.ResponseWriter, r *http.Request) {
+	var body userstruct.CreateInvitation
+	json.NewDecoder(r.Body).Decode(&body)
+
+	var invitation userservice.UserInvitations = userservice.Invite(&body, actor(r))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invitation)
+}
+
+func findInvitations(w http.ResponseWriter, r *http.Request) {
+	var invitations []userservice.UserInvitations
+	var httpsResponse int = userservice.FindInvitations(&invitations)
+	w.WriteHeader(httpsResponse)
+	json.NewEncoder(w).Encode(invitations)
+}
+
+func revokeInvitation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		panic(middlewares.GormError{Code: 400, Message: err.Error(), IsGorm: true})
+	}
+
+	userservice.RevokeInvitation(uint(id))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Invitation revoked successfully")
+}
+
+func getInvitation(w http.ResponseWriter, r *http.Request) {
+	var invitation userstruct.InvitationInfo = userservice.GetInvitation(mux.Vars(r)["token"])
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(invitation)
+}
+
+func acceptInvitation(w http.ResponseWriter, r *http.Request) {
+	var body userstruct.AcceptInvitation
+	json.NewDecoder(r.Body).Decode(&body)
+
+	var user userservice.Users = userservice.AcceptInvitation(&body)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
 // Register function
 
 func RegisterSubRoutes(router *mux.Router) {
@@ -105,6 +265,7 @@ func RegisterSubRoutes(router *mux.Router) {
 	usersUpdateValidator := usersRouter.NewRoute().Subrouter()
 	usersUpdateValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(userstruct.UpdateUser{})))
 	usersUpdateValidator.Use(middlewares.AuthHandler)
+	usersUpdateValidator.Use(middlewares.SessionOnlyHandler)
 	usersUpdateValidator.HandleFunc("/", update).Methods("PUT")
 
 	// ValidatorHandler - Create
@@ -112,16 +273,61 @@ func RegisterSubRoutes(router *mux.Router) {
 	userCreateValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(userstruct.CreateUser{})))
 	userCreateValidator.HandleFunc("/", create).Methods("POST")
 
+	// Email verification, public
+	verifyEmailValidator := usersRouter.NewRoute().Subrouter()
+	verifyEmailValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(userstruct.VerifyEmail{})))
+	verifyEmailValidator.HandleFunc("/verify-email", verifyEmail).Methods("POST")
+
+	resendVerificationValidator := usersRouter.NewRoute().Subrouter()
+	resendVerificationValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(userstruct.ResendVerification{})))
+	resendVerificationValidator.HandleFunc("/verify-email/resend", resendVerification).Methods("POST")
+
+	// Invitations, registered before /{id} so "invitations" is not taken as an id
+	acceptInvitationValidator := usersRouter.NewRoute().Subrouter()
+	acceptInvitationValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(userstruct.AcceptInvitation{})))
+	acceptInvitationValidator.HandleFunc("/invitations/accept", acceptInvitation).Methods("POST")
+
+	usersRouter.HandleFunc("/invitations/{token:[0-9a-f]+}", getInvitation).Methods("GET")
+
+	invitationsRouter := usersRouter.NewRoute().Subrouter()
+	invitationsRouter.Use(middlewares.AuthHandler)
+	invitationsRouter.Use(middlewares.RequirePermission(permissions.UsersWrite))
+	invitationsRouter.HandleFunc("/invitations", findInvitations).Methods("GET")
+	invitationsRouter.HandleFunc("/invitations/{id:[0-9]+}", revokeInvitation).Methods("DELETE")
+
+	createInvitationValidator := invitationsRouter.NewRoute().Subrouter()
+	createInvitationValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(userstruct.CreateInvitation{})))
+	createInvitationValidator.HandleFunc("/invitations", createInvitation).Methods("POST")
+
 	// Protected functions
 	usersProtected := usersRouter.NewRoute().Subrouter()
 	usersProtected.Use(middlewares.AuthHandler)
-	usersProtected.Use(middlewares.ProfilesHandler([]uint{1, 2, 4}))
+	usersProtected.Use(middlewares.RequirePermission(permissions.UsersRead))
 	usersProtected.HandleFunc("/", find).Methods("GET")
 	usersProtected.HandleFunc("/{id}", findOne).Methods("GET")
-	usersProtected.HandleFunc("/{id}", delete).Methods("DELETE")
+	usersProtected.HandleFunc("/{id}/scope", findScope).Methods("GET")
+
+	usersWrite := usersRouter.NewRoute().Subrouter()
+	usersWrite.Use(middlewares.AuthHandler)
+	usersWrite.Use(middlewares.RequirePermission(permissions.UsersWrite))
+	usersWrite.HandleFunc("/{id}", delete).Methods("DELETE")
+	usersWrite.HandleFunc("/{id}/deactivate", deactivate).Methods("POST")
+	usersWrite.HandleFunc("/{id}/reactivate", reactivate).Methods("POST")
+	usersWrite.HandleFunc("/{id}/restore", restore).Methods("POST")
+
+	// ValidatorHandler - Profiles, only admins assign them and never to themselves
+	usersProfilesValidator := usersWrite.NewRoute().Subrouter()
+	usersProfilesValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(userstruct.AssignProfiles{})))
+	usersProfilesValidator.HandleFunc("/{id}/profiles", assignProfiles).Methods("PUT")
+
+	// ValidatorHandler - Scope, links the user to hospitals and doctors
+	usersScopeValidator := usersWrite.NewRoute().Subrouter()
+	usersScopeValidator.Use(middlewares.ValidatorHandler(reflect.TypeOf(userstruct.UserScope{})))
+	usersScopeValidator.HandleFunc("/{id}/scope", updateScope).Methods("PUT")
 
 	// Find me
 	authenticatedRouter := usersRouter.NewRoute().Subrouter()
 	authenticatedRouter.Use(middlewares.AuthHandler)
+	authenticatedRouter.Use(middlewares.SessionOnlyHandler)
 	authenticatedRouter.HandleFunc("/find/me", findMe).Methods("GET")
 }
@@ -0,0 +1,273 @@
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/utils"
+
+	"github.com/golang-jwt/jwt"
+	"go.uber.org/zap"
+)
+
+var Logger *zap.Logger
+
+/*
+	Key set used to sign and verify the JWTs, every token carries the kid of its key.
+	JWT_KEYS_DIR holds the keys, the file name is the kid:
+		{kid}.pem      private key (RSA or Ed25519 PKCS8), signs when it is the active one and verifies
+		{kid}.pub.pem  public key only, verifies the tokens of a retired key until they expire
+	JWT_ACTIVE_KID chooses the signing key, it is required when there is more than one private
+	key, a copied or restored file must never change the key that signs.
+	Rotation: add the new key, change JWT_ACTIVE_KID, wait the access token lifetime and remove the old key.
+	The directory is read again every minute so no restart is needed.
+	JWTSECRET (HS256) is only used when there are no asymmetric keys or JWT_ACCEPT_HS256=true,
+	it is never published on the JWKS.
+*/
+
+const (
+	hmacKid        = "hs256"
+	reloadInterval = time.Minute
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private interface{} // nil on verify only keys
+	Public  interface{}
+}
+
+type keySet struct {
+	active *Key
+	keys   map[string]*Key
+}
+
+var (
+	mu      sync.RWMutex
+	current = &keySet{keys: map[string]*Key{}}
+)
+
+// Initialize the key set, it panics when there is no key to sign
+func InitJwtKeys() {
+	Logger = utils.NewLogger()
+
+	if err := Reload(); err != nil {
+		panic(err)
+	}
+
+	go func() {
+		for range time.Tick(reloadInterval) {
+			if err := Reload(); err != nil {
+				Logger.Error("Error reloading JWT keys, keeping the previous ones", zap.Error(err))
+			}
+		}
+	}()
+}
+
+func keysDir() string {
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		return dir
+	}
+	return "./keys"
+}
+
+func loadKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(path)
+	key := &Key{}
+
+	if strings.HasSuffix(name, ".pub.pem") {
+		key.ID = strings.TrimSuffix(name, ".pub.pem")
+		if public, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+			key.Method, key.Public = jwt.SigningMethodRS256, public
+			return key, nil
+		}
+		if public, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+			key.Method, key.Public = jwt.SigningMethodEdDSA, public
+			return key, nil
+		}
+		return nil, fmt.Errorf("%s is not a RSA or Ed25519 public key", name)
+	}
+
+	key.ID = strings.TrimSuffix(name, ".pem")
+	if private, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, private, &private.PublicKey
+		return key, nil
+	}
+	if private, err := jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+		edKey := private.(ed25519.PrivateKey)
+		key.Method, key.Private, key.Public = jwt.SigningMethodEdDSA, edKey, edKey.Public().(ed25519.PublicKey)
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s is not a RSA or Ed25519 private key", name)
+}
+
+// Reload reads the keys again, the previous set is kept when the new one is not valid
+func Reload() error {
+	set := &keySet{keys: map[string]*Key{}}
+
+	paths, _ := filepath.Glob(filepath.Join(keysDir(), "*.pem"))
+	sort.Strings(paths)
+	for _, path := range paths {
+		key, err := loadKey(path)
+		if err != nil {
+			return err
+		}
+		// A private key wins over its public copy
+		if existing, ok := set.keys[key.ID]; ok && existing.Private != nil {
+			continue
+		}
+		set.keys[key.ID] = key
+	}
+
+	asymmetric := len(set.keys) > 0
+	secret := os.Getenv("JWTSECRET")
+	if secret != "" && (!asymmetric || os.Getenv("JWT_ACCEPT_HS256") == "true") {
+		set.keys[hmacKid] = &Key{
+			ID:      hmacKid,
+			Method:  jwt.SigningMethodHS256,
+			Private: []byte(secret),
+			Public:  []byte(secret),
+		}
+	}
+
+	activeKid := os.Getenv("JWT_ACTIVE_KID")
+	if activeKid != "" {
+		set.active = set.keys[activeKid]
+		if set.active == nil || set.active.Private == nil {
+			return fmt.Errorf("JWT_ACTIVE_KID %s is not a private key of %s", activeKid, keysDir())
+		}
+	} else {
+		for _, key := range set.keys {
+			if key.Private == nil || (asymmetric && key.ID == hmacKid) {
+				continue
+			}
+			if set.active != nil {
+				return fmt.Errorf("there are several private keys on %s, set JWT_ACTIVE_KID", keysDir())
+			}
+			set.active = key
+		}
+	}
+
+	if set.active == nil {
+		return errors.New("there is no key to sign the JWTs, set JWTSECRET or add keys to JWT_KEYS_DIR")
+	}
+
+	mu.Lock()
+	changed := current.active == nil || current.active.ID != set.active.ID || len(current.keys) != len(set.keys)
+	current = set
+	mu.Unlock()
+
+	if changed {
+		Logger.Info(fmt.Sprintf("JWT keys loaded, signing with %s (%s), %d keys verify", set.active.ID, set.active.Method.Alg(), len(set.keys)))
+	}
+	return nil
+}
+
+// Sign creates the token with the active key
+func Sign(claims jwt.Claims) (string, error) {
+	mu.RLock()
+	key := current.active
+	mu.RUnlock()
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// Keyfunc finds the key of the token, the algorithm has to be the one of the key
+func Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		// Tokens from before the key set, only valid while HS256 is accepted
+		kid = hmacKid
+	}
+
+	mu.RLock()
+	key := current.keys[kid]
+	mu.RUnlock()
+
+	if key == nil {
+		return nil, ErrUnknownKey
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s for key %s", token.Method.Alg(), kid)
+	}
+
+	return key.Public, nil
+}
+
+// Parse validates the token with the key set
+func Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	parser := &jwt.Parser{
+		ValidMethods: []string{
+			jwt.SigningMethodRS256.Alg(),
+			jwt.SigningMethodEdDSA.Alg(),
+			jwt.SigningMethodHS256.Alg(),
+		},
+	}
+	return parser.ParseWithClaims(tokenString, claims, Keyfunc)
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys, the HMAC secret is never included
+func JWKS() JWKSet {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range current.keys {
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "RSA",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "OKP",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(public),
+			})
+		}
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
@@ -0,0 +1,139 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/utils"
+
+	"go.uber.org/zap"
+	mail "gopkg.in/mail.v2"
+)
+
+var Logger *zap.Logger
+
+type Message struct {
+	To      []string
+	Subject string
+	Text    string
+	HTML    string // optional, sent as alternative of Text
+}
+
+// Sender delivers the emails, the implementation is chosen with MAIL_DRIVER
+type Sender interface {
+	Send(msg Message) error
+}
+
+var DefaultSender Sender
+
+// Initialize the mailer, "smtp" sends real emails, "file" writes them to MAIL_OUTBOX. Without
+// a driver they are written too, with a warning, as no email would reach the users
+func InitMailer() {
+	Logger = utils.NewLogger()
+
+	driver := os.Getenv("MAIL_DRIVER")
+	switch driver {
+	case "smtp":
+		port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+		if err != nil {
+			Logger.Error(fmt.Sprint("Invalid SMTP_PORT value:", err))
+			port = 587
+		}
+		DefaultSender = &SMTPSender{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+		Logger.Info(fmt.Sprintf("Mailer using SMTP server %s:%d", os.Getenv("SMTP_HOST"), port))
+	default:
+		outbox := os.Getenv("MAIL_OUTBOX")
+		if outbox == "" {
+			outbox = "./mails"
+		}
+		DefaultSender = &FileSender{Dir: outbox}
+		if driver != "file" {
+			Logger.Warn(fmt.Sprintf("MAIL_DRIVER is %q, emails are NOT sent, they are written to %s. Use smtp in production or file to silence this", driver, outbox))
+			return
+		}
+		Logger.Info(fmt.Sprintf("Mailer writing emails to %s", outbox))
+	}
+}
+
+// Send delivers the message with the configured sender
+func Send(msg Message) error {
+	if DefaultSender == nil {
+		return fmt.Errorf("mailer is not initialized")
+	}
+	return DefaultSender.Send(msg)
+}
+
+// SMTPSender sends the emails through an SMTP server
+type SMTPSender struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTPSender) Send(msg Message) error {
+	m := mail.NewMessage()
+	m.SetHeader("From", s.From)
+	m.SetHeader("To", msg.To...)
+	m.SetHeader("Subject", msg.Subject)
+	m.SetBody("text/plain", msg.Text)
+	if msg.HTML != "" {
+		m.AddAlternative("text/html", msg.HTML)
+	}
+
+	dialer := mail.NewDialer(s.Host, s.Port, s.Username, s.Password)
+	if err := dialer.DialAndSend(m); err != nil {
+		Logger.Error("Error sending email", zap.Strings("to", msg.To), zap.Error(err))
+		return err
+	}
+
+	Logger.Info("Email sent", zap.Strings("to", msg.To), zap.String("subject", msg.Subject))
+	return nil
+}
+
+// FileSender is for development, every email is written as a .eml file and logged
+type FileSender struct {
+	Dir string
+}
+
+func (s *FileSender) Send(msg Message) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+
+	m := mail.NewMessage()
+	m.SetHeader("From", "no-reply@localhost")
+	m.SetHeader("To", msg.To...)
+	m.SetHeader("Subject", msg.Subject)
+	m.SetBody("text/plain", msg.Text)
+	if msg.HTML != "" {
+		m.AddAlternative("text/html", msg.HTML)
+	}
+
+	recipient := strings.NewReplacer("@", "_at_", "/", "_", "\\", "_").Replace(strings.Join(msg.To, ","))
+	name := fmt.Sprintf("%s_%s.eml", time.Now().Format("2006-01-02T15-04-05.000"), recipient)
+
+	file, err := os.Create(filepath.Join(s.Dir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := m.WriteTo(file); err != nil {
+		return err
+	}
+
+	Logger.Info("Email written to outbox", zap.Strings("to", msg.To), zap.String("subject", msg.Subject), zap.String("file", name))
+	return nil
+}
@@ -0,0 +1,251 @@
+package passwords
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	"github.com/Gamequic/LivePreviewBackend/utils"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var Logger *zap.Logger
+
+/*
+	Password policy. The rules come from the environment:
+	PASSWORD_MIN_LENGTH                 minimum length, 8 by default and never less
+	PASSWORD_REQUIRE_{UPPERCASE,LOWERCASE,DIGIT,SYMBOL}  character classes, off by default
+	PASSWORD_CHECK_BREACHED             reject the passwords of the list, on by default
+	PASSWORD_BREACHED_LIST              extra list, one password per line, for a top list bigger
+	                                    than the bundled one
+	PASSWORD_HISTORY                    how many previous passwords can not be reused, 5 by default
+	PASSWORD_MAX_AGE_DAYS               days before the password must be changed, 0 disables it
+*/
+
+//go:embed common-passwords.txt
+var bundledList string
+
+// Policy is also returned to the frontend so it can show the rules
+type Policy struct {
+	MinLength        int  `json:"min_length"`
+	RequireUppercase bool `json:"require_uppercase"`
+	RequireLowercase bool `json:"require_lowercase"`
+	RequireDigit     bool `json:"require_digit"`
+	RequireSymbol    bool `json:"require_symbol"`
+	CheckBreached    bool `json:"check_breached"`
+	History          int  `json:"history"`
+	MaxAgeDays       int  `json:"max_age_days"`
+}
+
+// Previous password hashes of a user
+type PasswordHistories struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index;not null"`
+	Hash      string `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+var (
+	policy   Policy
+	breached = map[string]bool{}
+)
+
+// Error lists every rule the password does not follow
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "Password " + strings.Join(e.Problems, ", ")
+}
+
+// Initialize the policy, the breached list and the history table
+func InitPasswords() {
+	Logger = utils.NewLogger()
+	err := database.DB.AutoMigrate(&PasswordHistories{})
+	if err != nil {
+		Logger.Error(fmt.Sprint("Failed to migrate database:", err))
+	}
+
+	policy = Policy{
+		MinLength:        envInt("PASSWORD_MIN_LENGTH", 8),
+		RequireUppercase: envBool("PASSWORD_REQUIRE_UPPERCASE", false),
+		RequireLowercase: envBool("PASSWORD_REQUIRE_LOWERCASE", false),
+		RequireDigit:     envBool("PASSWORD_REQUIRE_DIGIT", false),
+		RequireSymbol:    envBool("PASSWORD_REQUIRE_SYMBOL", false),
+		CheckBreached:    envBool("PASSWORD_CHECK_BREACHED", true),
+		History:          envInt("PASSWORD_HISTORY", 5),
+		MaxAgeDays:       envInt("PASSWORD_MAX_AGE_DAYS", 0),
+	}
+	if policy.MinLength < 8 {
+		policy.MinLength = 8
+	}
+
+	loadList(strings.NewReader(bundledList))
+	if path := os.Getenv("PASSWORD_BREACHED_LIST"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			Logger.Error("Error opening the breached passwords list", zap.String("path", path), zap.Error(err))
+		} else {
+			loadList(file)
+			file.Close()
+		}
+	}
+	Logger.Info(fmt.Sprintf("Password policy loaded, %d breached passwords", len(breached)))
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
+
+func envBool(name string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func loadList(reader io.Reader) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// A password under the minimum length is rejected before it is looked up
+		if line == "" || strings.HasPrefix(line, "#") || len([]rune(line)) < policy.MinLength {
+			continue
+		}
+		breached[strings.ToLower(line)] = true
+	}
+}
+
+// Current returns the policy in use
+func Current() Policy {
+	return policy
+}
+
+// Validate checks the password against the policy, the email and name of the owner can not be on it
+func Validate(password string, email string, name string) error {
+	var problems []string
+
+	if len([]rune(password)) < policy.MinLength {
+		problems = append(problems, fmt.Sprintf("must have at least %d characters", policy.MinLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, char := range password {
+		switch {
+		case unicode.IsUpper(char):
+			upper = true
+		case unicode.IsLower(char):
+			lower = true
+		case unicode.IsDigit(char):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if policy.RequireUppercase && !upper {
+		problems = append(problems, "must have an uppercase letter")
+	}
+	if policy.RequireLowercase && !lower {
+		problems = append(problems, "must have a lowercase letter")
+	}
+	if policy.RequireDigit && !digit {
+		problems = append(problems, "must have a digit")
+	}
+	if policy.RequireSymbol && !symbol {
+		problems = append(problems, "must have a symbol")
+	}
+
+	lowered := strings.ToLower(password)
+	for _, part := range personalParts(email, name) {
+		if strings.Contains(lowered, part) {
+			problems = append(problems, "can not contain your name or email")
+			break
+		}
+	}
+
+	if policy.CheckBreached && breached[lowered] {
+		problems = append(problems, "is too common or appeared in a data breach")
+	}
+
+	if len(problems) > 0 {
+		return &Error{Problems: problems}
+	}
+	return nil
+}
+
+// personalParts are the pieces of the email and name worth checking, short ones are ignored
+func personalParts(email string, name string) []string {
+	var parts []string
+	local, _, _ := strings.Cut(strings.ToLower(email), "@")
+	fields := strings.FieldsFunc(local, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	fields = append(fields, local)
+	fields = append(fields, strings.Fields(strings.ToLower(name))...)
+	for _, field := range fields {
+		if len([]rune(field)) >= 3 {
+			parts = append(parts, field)
+		}
+	}
+	return parts
+}
+
+// Reused tells if the password is one of the last ones of the user
+func Reused(userID uint, password string) bool {
+	if policy.History == 0 {
+		return false
+	}
+
+	var hashes []string
+	database.DB.Model(&PasswordHistories{}).
+		Where("user_id = ?", userID).
+		Order("created_at DESC").
+		Limit(policy.History).
+		Pluck("hash", &hashes)
+
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Remember stores the new hash and forgets the ones beyond the history
+func Remember(tx *gorm.DB, userID uint, hash string) error {
+	if err := tx.Create(&PasswordHistories{UserID: userID, Hash: hash}).Error; err != nil {
+		return err
+	}
+
+	keep := policy.History
+	if keep == 0 {
+		keep = 1
+	}
+	return tx.Exec(`
+		DELETE FROM password_histories
+		WHERE user_id = ? AND id NOT IN (
+			SELECT id FROM password_histories WHERE user_id = ? ORDER BY created_at DESC, id DESC LIMIT ?
+		)`, userID, userID, keep).Error
+}
+
+// Expired tells if a password changed at that time has to be changed
+func Expired(changedAt time.Time) bool {
+	if policy.MaxAgeDays == 0 {
+		return false
+	}
+	return time.Since(changedAt) > time.Duration(policy.MaxAgeDays)*24*time.Hour
+}
@@ -0,0 +1,228 @@
+package permissions
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	"github.com/Gamequic/LivePreviewBackend/utils"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var Logger *zap.Logger
+
+/*
+	Named permissions given to the profiles, the routes ask for a permission instead of profile ids.
+	profile_permissions stores the mapping and it is edited through the profiles API.
+	All grants every permission, it is given to root.
+*/
+
+const (
+	UsersRead          = "users:read"
+	UsersWrite         = "users:write"
+	ProfilesRead       = "profiles:read"
+	ProfilesWrite      = "profiles:write"
+	AuthAdmin          = "auth:admin" // close sessions of other users, unlock accounts
+	PiecesRead         = "pieces:read"
+	PiecesWrite        = "pieces:write"
+	PiecesSign         = "pieces:sign" // sign the reports, the pathologists
+	HospitalsRead      = "hospitals:read"
+	DoctorsRead        = "doctors:read"
+	FilesRead          = "files:read"
+	FilesWrite         = "files:write"
+	LogsRead           = "logs:read"
+	NotificationsRead  = "notifications:read"
+	NotificationsWrite = "notifications:write"
+	SystemRead         = "system:read"
+	ScopeGlobal        = "scope:global" // see the records of every hospital and doctor (lab staff)
+
+	All = "*"
+)
+
+// Catalog is every permission that can be given
+var Catalog = []string{
+	UsersRead, UsersWrite,
+	ProfilesRead, ProfilesWrite,
+	AuthAdmin,
+	PiecesRead, PiecesWrite, PiecesSign,
+	HospitalsRead, DoctorsRead,
+	FilesRead, FilesWrite,
+	LogsRead,
+	NotificationsRead, NotificationsWrite,
+	SystemRead,
+	ScopeGlobal,
+}
+
+// Permissions given to the default profiles of sql/init.sql, by profile name.
+// Each permission is given once, when it appears, so later edits are not overwritten.
+var defaults = map[string][]string{
+	"root":          {All},
+	"admin":         Catalog,
+	"guest":         {PiecesRead, HospitalsRead, DoctorsRead, FilesRead},
+	"users":         {UsersRead, PiecesRead, PiecesWrite, HospitalsRead, DoctorsRead, FilesRead, FilesWrite, ScopeGlobal},
+	"performance":   {LogsRead, SystemRead},
+	"logs":          {LogsRead},
+	"notifications": {NotificationsRead, NotificationsWrite},
+}
+
+type ProfilePermissions struct {
+	ProfileID  int    `gorm:"primaryKey"`
+	Permission string `gorm:"primaryKey"`
+}
+
+// Permissions already given to the default profiles
+type PermissionSeeds struct {
+	Permission string `gorm:"primaryKey"`
+}
+
+// The mapping is read on every request, so it is cached for a while
+const cacheTTL = 30 * time.Second
+
+var (
+	cacheMu     sync.RWMutex
+	cache       map[int][]string
+	cacheLoaded time.Time
+)
+
+// Initialize the permissions, the profiles have to exist before
+func InitPermissions() {
+	Logger = utils.NewLogger()
+	err := database.DB.AutoMigrate(&ProfilePermissions{}, &PermissionSeeds{})
+	if err != nil {
+		Logger.Error(fmt.Sprint("Failed to migrate database:", err))
+		return
+	}
+
+	var seeded []string
+	database.DB.Model(&PermissionSeeds{}).Pluck("permission", &seeded)
+	done := map[string]bool{}
+	for _, permission := range seeded {
+		done[permission] = true
+	}
+
+	for _, permission := range append([]string{All}, Catalog...) {
+		if done[permission] {
+			continue
+		}
+		if err := seed(permission); err != nil {
+			Logger.Error(fmt.Sprintf("Failed to give the permission %s to the default profiles", permission), zap.Error(err))
+			continue
+		}
+		Logger.Info(fmt.Sprintf("Permission %s given to the default profiles", permission))
+	}
+}
+
+func seed(permission string) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		for name, granted := range defaults {
+			for _, candidate := range granted {
+				if candidate != permission {
+					continue
+				}
+				var profileId int
+				tx.Raw("SELECT id FROM profiles WHERE name = ?", name).Scan(&profileId)
+				if profileId == 0 {
+					continue
+				}
+				if err := tx.FirstOrCreate(&ProfilePermissions{ProfileID: profileId, Permission: permission}).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Create(&PermissionSeeds{Permission: permission}).Error
+	})
+}
+
+// IsValid tells if the permission exists on the catalog
+func IsValid(permission string) bool {
+	if permission == All {
+		return true
+	}
+	for _, known := range Catalog {
+		if known == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func load() map[int][]string {
+	cacheMu.RLock()
+	if cache != nil && time.Since(cacheLoaded) < cacheTTL {
+		defer cacheMu.RUnlock()
+		return cache
+	}
+	cacheMu.RUnlock()
+
+	var rows []ProfilePermissions
+	if err := database.DB.Find(&rows).Error; err != nil {
+		Logger.Error("Error loading permissions", zap.Error(err))
+		return map[int][]string{}
+	}
+
+	mapping := map[int][]string{}
+	for _, row := range rows {
+		mapping[row.ProfileID] = append(mapping[row.ProfileID], row.Permission)
+	}
+
+	cacheMu.Lock()
+	cache = mapping
+	cacheLoaded = time.Now()
+	cacheMu.Unlock()
+
+	return mapping
+}
+
+func invalidate() {
+	cacheMu.Lock()
+	cache = nil
+	cacheMu.Unlock()
+}
+
+// OfProfile returns the permissions of a profile
+func OfProfile(profileId int) []string {
+	permissions := append([]string{}, load()[profileId]...)
+	sort.Strings(permissions)
+	return permissions
+}
+
+// Set replaces the permissions of a profile
+func Set(profileId int, permissions []string) error {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("profile_id = ?", profileId).Delete(&ProfilePermissions{}).Error; err != nil {
+			return err
+		}
+		for _, permission := range permissions {
+			row := ProfilePermissions{ProfileID: profileId, Permission: permission}
+			if err := tx.Create(&row).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	invalidate()
+	return err
+}
+
+// Has tells if any of the profiles has the permission, the profiles come as in the token
+func Has(profiles []string, permission string) bool {
+	mapping := load()
+	for _, profile := range profiles {
+		profileId, err := strconv.Atoi(profile)
+		if err != nil {
+			continue
+		}
+		for _, granted := range mapping[profileId] {
+			if granted == All || granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package scope
+
+import (
+	"fmt"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
+	"github.com/Gamequic/LivePreviewBackend/utils"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var Logger *zap.Logger
+
+/*
+	Row level access. Hospital and doctor staff are linked to their hospitals or doctors and
+	only see the records of them, the lab staff (permission scope:global) see everything.
+	A user without links and without the permission sees nothing.
+*/
+
+type UserHospitals struct {
+	UserID     uint `gorm:"primaryKey"`
+	HospitalID uint `gorm:"primaryKey"`
+}
+
+type UserDoctors struct {
+	UserID   uint `gorm:"primaryKey"`
+	DoctorID uint `gorm:"primaryKey"`
+}
+
+// Scope of a user for one request
+type Scope struct {
+	UserID      int
+	Global      bool
+	HospitalIDs []uint
+	DoctorIDs   []uint
+}
+
+// Initialize the scope tables
+func InitScope() {
+	Logger = utils.NewLogger()
+	err := database.DB.AutoMigrate(&UserHospitals{}, &UserDoctors{})
+	if err != nil {
+		Logger.Error(fmt.Sprint("Failed to migrate database:", err))
+	}
+}
+
+// ForUser builds the scope of the user, the profiles come as in the token
+func ForUser(userId int, profiles []string) Scope {
+	scope := Scope{UserID: userId}
+	if permissions.Has(profiles, permissions.ScopeGlobal) {
+		scope.Global = true
+		return scope
+	}
+
+	database.DB.Model(&UserHospitals{}).Where("user_id = ?", userId).Pluck("hospital_id", &scope.HospitalIDs)
+	database.DB.Model(&UserDoctors{}).Where("user_id = ?", userId).Pluck("doctor_id", &scope.DoctorIDs)
+	return scope
+}
+
+// Never an empty IN, it is not valid SQL
+func orNone(ids []uint) []uint {
+	if len(ids) == 0 {
+		return []uint{0}
+	}
+	return ids
+}
+
+// HospitalIDsOrNone can be used on an IN even when there are no hospitals
+func (s Scope) HospitalIDsOrNone() []uint {
+	return orNone(s.HospitalIDs)
+}
+
+// DoctorIDsOrNone can be used on an IN even when there are no doctors
+func (s Scope) DoctorIDsOrNone() []uint {
+	return orNone(s.DoctorIDs)
+}
+
+// Apply restricts a query of records that belong to a hospital and a doctor
+func (s Scope) Apply(query *gorm.DB, hospitalColumn string, doctorColumn string) *gorm.DB {
+	if s.Global {
+		return query
+	}
+	return query.Where(
+		fmt.Sprintf("(%s IN ? OR %s IN ?)", hospitalColumn, doctorColumn),
+		s.HospitalIDsOrNone(), s.DoctorIDsOrNone(),
+	)
+}
+
+// Allows tells if a record of the hospital and doctor is inside the scope
+func (s Scope) Allows(hospitalId uint, doctorId uint) bool {
+	if s.Global {
+		return true
+	}
+	for _, id := range s.HospitalIDs {
+		if id == hospitalId {
+			return true
+		}
+	}
+	for _, id := range s.DoctorIDs {
+		if id == doctorId {
+			return true
+		}
+	}
+	return false
+}
+
+// Links returns the hospitals and doctors linked to a user
+func Links(userId uint) ([]uint, []uint) {
+	hospitalIds := []uint{}
+	doctorIds := []uint{}
+	database.DB.Model(&UserHospitals{}).Where("user_id = ?", userId).Pluck("hospital_id", &hospitalIds)
+	database.DB.Model(&UserDoctors{}).Where("user_id = ?", userId).Pluck("doctor_id", &doctorIds)
+	return hospitalIds, doctorIds
+}
+
+// SetLinks replaces the hospitals and doctors linked to a user
+func SetLinks(userId uint, hospitalIds []uint, doctorIds []uint) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userId).Delete(&UserHospitals{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userId).Delete(&UserDoctors{}).Error; err != nil {
+			return err
+		}
+		for _, id := range hospitalIds {
+			if err := tx.FirstOrCreate(&UserHospitals{UserID: userId, HospitalID: id}).Error; err != nil {
+				return err
+			}
+		}
+		for _, id := range doctorIds {
+			if err := tx.FirstOrCreate(&UserDoctors{UserID: userId, DoctorID: id}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
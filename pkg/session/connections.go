@@ -0,0 +1,107 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+
+	"go.uber.org/zap"
+)
+
+/*
+	Long lived connections (websockets) are authenticated once, so they have to be
+	closed when their session is revoked. Revocations are published on Redis so every
+	instance of the server closes the connections it holds.
+*/
+
+const revocationsChannel = "sessions:revoked"
+
+type revocation struct {
+	UserID    int    `json:"user_id"`
+	SessionID string `json:"session_id,omitempty"` // empty means every session of the user
+}
+
+type connection struct {
+	sessionID string
+	close     func()
+}
+
+var (
+	connectionsMu sync.Mutex
+	connections   = map[int]map[*connection]struct{}{}
+)
+
+// TrackConnection registers a connection of the session, the returned function must be
+// called when the connection ends
+func TrackConnection(userID int, sessionID string, close func()) func() {
+	conn := &connection{sessionID: sessionID, close: close}
+
+	connectionsMu.Lock()
+	if connections[userID] == nil {
+		connections[userID] = map[*connection]struct{}{}
+	}
+	connections[userID][conn] = struct{}{}
+	connectionsMu.Unlock()
+
+	return func() {
+		connectionsMu.Lock()
+		delete(connections[userID], conn)
+		if len(connections[userID]) == 0 {
+			delete(connections, userID)
+		}
+		connectionsMu.Unlock()
+	}
+}
+
+func publishRevocation(userID int, sessionID string) {
+	payload, err := json.Marshal(revocation{UserID: userID, SessionID: sessionID})
+	if err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	if err := database.RedisClient.Publish(ctx, revocationsChannel, payload).Err(); err != nil {
+		Logger.Error("Error publishing session revocation", zap.Error(err))
+	}
+}
+
+func closeConnections(rev revocation) {
+	connectionsMu.Lock()
+	var toClose []*connection
+	for conn := range connections[rev.UserID] {
+		if rev.SessionID == "" || conn.sessionID == rev.SessionID {
+			toClose = append(toClose, conn)
+		}
+	}
+	connectionsMu.Unlock()
+
+	// Closed outside the lock, closing makes the handlers untrack themselves
+	for _, conn := range toClose {
+		conn.close()
+	}
+
+	if len(toClose) > 0 {
+		Logger.Info(fmt.Sprintf("Closed %d connections of user %d after session revocation", len(toClose), rev.UserID))
+	}
+}
+
+// Listen the revocations of every instance
+func listenRevocations() {
+	ctx := context.Background()
+	pubsub := database.RedisClient.Subscribe(ctx, revocationsChannel)
+
+	go func() {
+		defer pubsub.Close()
+		for msg := range pubsub.Channel() {
+			var rev revocation
+			if err := json.Unmarshal([]byte(msg.Payload), &rev); err != nil {
+				Logger.Error("Invalid session revocation", zap.Error(err))
+				continue
+			}
+			closeConnections(rev)
+		}
+	}()
+}
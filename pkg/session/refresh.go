@@ -0,0 +1,106 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Gamequic/LivePreviewBackend/pkg/database"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token already used")
+)
+
+func refreshKey(sessionID string) string {
+	return fmt.Sprintf("session:%s:refresh", sessionID)
+}
+
+func refreshUsedKey(sessionID string) string {
+	return fmt.Sprintf("session:%s:refresh_used", sessionID)
+}
+
+// Compare and swap of the refresh token of a session
+// -1 the token is not the current one and was never issued, or the session expired
+// -2 the token was already rotated, someone is replaying it
+// otherwise returns the user id of the session
+var rotateScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'hash')
+if not current then
+	return -1
+end
+if current ~= ARGV[1] then
+	if redis.call('SISMEMBER', KEYS[2], ARGV[1]) == 1 then
+		return -2
+	end
+	return -1
+end
+redis.call('SADD', KEYS[2], ARGV[1])
+redis.call('HSET', KEYS[1], 'hash', ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+return tonumber(redis.call('HGET', KEYS[1], 'user_id'))
+`)
+
+// StoreRefreshToken saves the hash of the first refresh token of a session
+func StoreRefreshToken(sessionID string, userID int, tokenHash string, ttl time.Duration) error {
+	ctx := context.Background()
+	key := refreshKey(sessionID)
+
+	_, err := database.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "hash", tokenHash, "user_id", userID)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		Logger.Error("Error storing refresh token", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// RotateRefreshToken replaces the refresh token of the session and returns the owner.
+// If an old token is presented the whole session is revoked.
+func RotateRefreshToken(sessionID string, presentedHash string, newHash string, ttl time.Duration) (int, error) {
+	ctx := context.Background()
+
+	result, err := rotateScript.Run(ctx, database.RedisClient,
+		[]string{refreshKey(sessionID), refreshUsedKey(sessionID)},
+		presentedHash, newHash, ttl.Milliseconds(),
+	).Int()
+	if err != nil {
+		Logger.Error("Error rotating refresh token", zap.Error(err))
+		return 0, err
+	}
+
+	switch result {
+	case -1:
+		return 0, ErrRefreshTokenInvalid
+	case -2:
+		userID, _ := database.RedisClient.HGet(ctx, refreshKey(sessionID), "user_id").Int()
+		Logger.Warn(fmt.Sprintf("Refresh token reused on session %s of user %d, revoking session", sessionID, userID))
+		RemoveSessionByID(userID, sessionID)
+		return 0, ErrRefreshTokenReused
+	}
+
+	return result, nil
+}
+
+// RemoveRefreshToken deletes the refresh tokens of the session
+func RemoveRefreshToken(sessionID string) error {
+	ctx := context.Background()
+
+	err := database.RedisClient.Del(ctx, refreshKey(sessionID), refreshUsedKey(sessionID)).Err()
+	if err != nil {
+		Logger.Error("Error removing refresh token", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
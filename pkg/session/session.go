@@ -2,35 +2,95 @@ package session
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/Gamequic/LivePreviewBackend/pkg/database"
 	authstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/struct"
 	"github.com/Gamequic/LivePreviewBackend/utils"
 
+	"github.com/go-redis/redis/v8"
 	"go.uber.org/zap"
 )
 
 var Logger *zap.Logger
 
+/*
+	Redis layout
+	session:{sessionID}         hash with the metadata of the session, expires with the refresh token
+	user:{userID}:sessions      set with the session ids of the user, used to list and revoke them
+	The token itself is never stored.
+*/
+
+// last_seen is written at most once per this interval, validation happens on every request
+const lastSeenInterval = time.Minute
+
+// Only touch sessions that still exist, a plain HSET would recreate an expired one without TTL
+var touchScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('HSET', KEYS[1], 'last_seen', ARGV[1])
+end
+return 0
+`)
+
 func InitSessionService() {
 	Logger = utils.NewLogger()
+	listenRevocations()
 }
 
-func StoreSession(userID int, sessionData *authstruct.Session) error {
-	ctx := context.Background()
-	key := fmt.Sprintf("user:%d:sessions", userID)
+func sessionKey(sessionID string) string {
+	return fmt.Sprintf("session:%s", sessionID)
+}
+
+func userSessionsKey(userID int) string {
+	return fmt.Sprintf("user:%d:sessions", userID)
+}
 
-	sessionJSON, err := json.Marshal(sessionData)
+func StoreSession(userID int, sessionData *authstruct.Session, ttl time.Duration) error {
+	ctx := context.Background()
+	now := time.Now().UTC().Format(time.RFC3339)
+	sessionData.CreatedAt = now
+	sessionData.LastSeen = now
+
+	key := sessionKey(sessionData.SessionID)
+	indexKey := userSessionsKey(userID)
+
+	_, err := database.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			"user_id", userID,
+			"email", sessionData.Email,
+			"username", sessionData.Username,
+			"created_at", sessionData.CreatedAt,
+			"last_seen", sessionData.LastSeen,
+			"ip", sessionData.IP,
+			"user_agent", sessionData.UserAgent,
+			"device_name", sessionData.DeviceName,
+		)
+		pipe.Expire(ctx, key, ttl)
+		pipe.SAdd(ctx, indexKey, sessionData.SessionID)
+		pipe.Expire(ctx, indexKey, ttl)
+		return nil
+	})
 	if err != nil {
-		Logger.Error("Error marshaling session data", zap.Error(err))
+		Logger.Error("Error storing session", zap.Error(err))
 		return err
 	}
 
-	err = database.RedisClient.SAdd(ctx, key, sessionJSON).Err()
+	return nil
+}
+
+// ExtendSession moves the expiration of the session, used when the refresh token rotates
+func ExtendSession(sessionID string, userID int, ttl time.Duration) error {
+	ctx := context.Background()
+
+	_, err := database.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Expire(ctx, sessionKey(sessionID), ttl)
+		pipe.Expire(ctx, userSessionsKey(userID), ttl)
+		return nil
+	})
 	if err != nil {
-		Logger.Error("Error storing session", zap.Error(err))
+		Logger.Error("Error extending session", zap.Error(err))
 		return err
 	}
 
@@ -39,76 +99,135 @@ func StoreSession(userID int, sessionData *authstruct.Session) error {
 
 func GetUserSessions(userID int) ([]authstruct.Session, error) {
 	ctx := context.Background()
-	key := fmt.Sprintf("user:%d:sessions", userID)
+	indexKey := userSessionsKey(userID)
 
-	sessionJSONs, err := database.RedisClient.SMembers(ctx, key).Result()
+	sessionIDs, err := database.RedisClient.SMembers(ctx, indexKey).Result()
 	if err != nil {
 		Logger.Error("Error getting sessions", zap.Error(err))
 		return nil, err
 	}
 
+	pipe := database.RedisClient.Pipeline()
+	commands := make([]*redis.StringStringMapCmd, len(sessionIDs))
+	for i, sessionID := range sessionIDs {
+		commands[i] = pipe.HGetAll(ctx, sessionKey(sessionID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		Logger.Error("Error getting sessions", zap.Error(err))
+		return nil, err
+	}
+
 	sessions := make([]authstruct.Session, 0)
-	for _, sessionJSON := range sessionJSONs {
-		var session authstruct.Session
-		if err := json.Unmarshal([]byte(sessionJSON), &session); err != nil {
-			Logger.Error("Error unmarshaling session", zap.Error(err))
+	for i, command := range commands {
+		fields := command.Val()
+
+		// The hash expired, clean the index
+		if len(fields) == 0 {
+			database.RedisClient.SRem(ctx, indexKey, sessionIDs[i])
 			continue
 		}
-		sessions = append(sessions, session)
+
+		sessions = append(sessions, authstruct.Session{
+			UserID:     userID,
+			Email:      fields["email"],
+			Username:   fields["username"],
+			SessionID:  sessionIDs[i],
+			CreatedAt:  fields["created_at"],
+			LastSeen:   fields["last_seen"],
+			IP:         fields["ip"],
+			UserAgent:  fields["user_agent"],
+			DeviceName: fields["device_name"],
+		})
 	}
 
 	return sessions, nil
 }
 
-func RemoveSession(userID int, tokenString string) error {
+func RemoveSessionByID(userID int, sessionID string) error {
 	ctx := context.Background()
-	key := fmt.Sprintf("user:%d:sessions", userID)
 
-	sessions, err := GetUserSessions(userID)
+	_, err := database.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(sessionID))
+		pipe.SRem(ctx, userSessionsKey(userID), sessionID)
+		return nil
+	})
 	if err != nil {
+		Logger.Error("Error removing session", zap.Error(err))
 		return err
 	}
 
-	for _, session := range sessions {
-		if session.Token == tokenString {
-			sessionJSON, err := json.Marshal(session)
-			if err != nil {
-				Logger.Error("Error marshaling session", zap.Error(err))
-				continue
-			}
-
-			err = database.RedisClient.SRem(ctx, key, sessionJSON).Err()
-			if err != nil {
-				Logger.Error("Error removing session", zap.Error(err))
-				return err
-			}
-			break
+	publishRevocation(userID, sessionID)
+	return RemoveRefreshToken(sessionID)
+}
+
+// RemoveOtherSessions closes every session of the user except the given one
+func RemoveOtherSessions(userID int, keepSessionID string) (int, error) {
+	ctx := context.Background()
+
+	sessionIDs, err := database.RedisClient.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		Logger.Error("Error getting sessions", zap.Error(err))
+		return 0, err
+	}
+
+	removed := 0
+	for _, sessionID := range sessionIDs {
+		if sessionID == keepSessionID {
+			continue
 		}
+		if err := RemoveSessionByID(userID, sessionID); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+func RemoveAllSessions(userID int) error {
+	ctx := context.Background()
+	indexKey := userSessionsKey(userID)
+
+	sessionIDs, err := database.RedisClient.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		Logger.Error("Error getting sessions", zap.Error(err))
+		return err
 	}
 
+	keys := []string{indexKey}
+	for _, sessionID := range sessionIDs {
+		keys = append(keys, sessionKey(sessionID), refreshKey(sessionID), refreshUsedKey(sessionID))
+	}
+
+	err = database.RedisClient.Del(ctx, keys...).Err()
+	if err != nil {
+		Logger.Error("Error removing sessions", zap.Error(err))
+		return err
+	}
+
+	publishRevocation(userID, "")
 	return nil
 }
 
 func ValidateSession(sessionID string, userID int) error {
 	ctx := context.Background()
-	key := fmt.Sprintf("user:%d:sessions", userID)
+	key := sessionKey(sessionID)
 
-	sessionJSONs, err := database.RedisClient.SMembers(ctx, key).Result()
+	fields, err := database.RedisClient.HMGet(ctx, key, "user_id", "last_seen").Result()
 	if err != nil {
-		Logger.Error("Error getting sessions", zap.Error(err))
+		Logger.Error("Error getting session", zap.Error(err))
 		return err
 	}
 
-	for _, sessionJSON := range sessionJSONs {
-		var session authstruct.Session
-		if err := json.Unmarshal([]byte(sessionJSON), &session); err != nil {
-			Logger.Error("Error unmarshaling session", zap.Error(err))
-			continue
-		}
-		if session.SessionID == sessionID {
-			return nil
-		}
+	owner, _ := fields[0].(string)
+	if owner == "" || owner != strconv.Itoa(userID) {
+		return fmt.Errorf("session not found or expired")
 	}
 
-	return fmt.Errorf("session not found or expired")
+	lastSeen, _ := fields[1].(string)
+	if seen, err := time.Parse(time.RFC3339, lastSeen); err != nil || time.Since(seen) > lastSeenInterval {
+		touchScript.Run(ctx, database.RedisClient, []string{key}, time.Now().UTC().Format(time.RFC3339))
+	}
+
+	return nil
 }
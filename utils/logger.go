@@ -8,6 +8,9 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
+// LogTimeLayout is the format of the time in the log files, in the local time
+const LogTimeLayout = "2006/01/02 3:04:05 pm"
+
 func NewLogger() *zap.Logger {
 	today := time.Now()
 	year := today.Format("2006")
@@ -29,7 +32,7 @@ func NewLogger() *zap.Logger {
 	encoderConfig.LevelKey = "level"
 	encoderConfig.CallerKey = "caller"
 	encoderConfig.StacktraceKey = "stacktrace"
-	encoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout("2006/01/02 3:04:05 pm")
+	encoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(LogTimeLayout)
 	encoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
 
 	consoleEncoder := zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
@@ -41,6 +44,10 @@ func NewLogger() *zap.Logger {
 			return l >= zapcore.InfoLevel
 		})),
 		zapcore.NewCore(consoleEncoder, zapcore.Lock(os.Stdout), zap.DebugLevel),
+		// Same entries as the file for the live tail, only while someone listens
+		zapcore.NewCore(fileEncoder.Clone(), liveLogWriter{}, zap.LevelEnablerFunc(func(l zapcore.Level) bool {
+			return l >= zapcore.InfoLevel && logListening.Load()
+		})),
 	)
 
 	logger := zap.New(core)
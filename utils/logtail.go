@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	Live copy of the log entries for the tail of the logs viewer. Every logger made by NewLogger
+	hands its entries here too, whatever file it writes to, and nothing is encoded twice while
+	nobody listens. A listener that does not keep up loses entries instead of slowing the logger.
+*/
+
+// LogListener receives the JSON of each entry on C
+type LogListener struct {
+	C       chan []byte
+	dropped atomic.Int64
+}
+
+// Dropped returns how many entries were lost since the last call, because C was full
+func (l *LogListener) Dropped() int64 {
+	return l.dropped.Swap(0)
+}
+
+var (
+	logListenersMu sync.RWMutex
+	logListeners   = map[*LogListener]struct{}{}
+	logListening   atomic.Bool
+)
+
+// ListenLogs registers a listener with room for buffer entries, the function removes it
+func ListenLogs(buffer int) (*LogListener, func()) {
+	listener := &LogListener{C: make(chan []byte, buffer)}
+
+	logListenersMu.Lock()
+	logListeners[listener] = struct{}{}
+	logListening.Store(true)
+	logListenersMu.Unlock()
+
+	return listener, func() {
+		logListenersMu.Lock()
+		delete(logListeners, listener)
+		logListening.Store(len(logListeners) > 0)
+		logListenersMu.Unlock()
+	}
+}
+
+// liveLogWriter receives one encoded entry on each Write
+type liveLogWriter struct{}
+
+func (liveLogWriter) Write(entry []byte) (int, error) {
+	logListenersMu.RLock()
+	defer logListenersMu.RUnlock()
+
+	for listener := range logListeners {
+		// The buffer of zap is reused, every listener gets its own copy
+		copied := append([]byte(nil), entry...)
+		select {
+		case listener.C <- copied:
+		default:
+			listener.dropped.Add(1)
+		}
+	}
+	return len(entry), nil
+}
+
+func (liveLogWriter) Sync() error {
+	return nil
+}
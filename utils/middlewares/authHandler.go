@@ -3,11 +3,13 @@ package middlewares
 import (
 	"context"
 	"net/http"
-	"os"
 	"strings"
 
+	"github.com/Gamequic/LivePreviewBackend/pkg/apikeys"
 	authstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/struct"
+	"github.com/Gamequic/LivePreviewBackend/pkg/jwtkeys"
 	"github.com/Gamequic/LivePreviewBackend/pkg/session"
+	"github.com/Gamequic/LivePreviewBackend/utils"
 
 	"github.com/golang-jwt/jwt"
 )
@@ -22,7 +24,14 @@ const (
 
 func AuthHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var jwtKey = []byte(os.Getenv("JWTSECRET"))
+		// Integrations use API keys instead of a session
+		if key := r.Header.Get(apikeys.Header); key != "" {
+			tokenData := validateApiKey(key, r)
+			ctx := context.WithValue(r.Context(), UserIDKey, tokenData.Id)
+			ctx = context.WithValue(ctx, UserKey, tokenData)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
 
 		// Get token from Authorization header
 		authHeader := r.Header.Get("Authorization")
@@ -39,9 +48,7 @@ func AuthHandler(next http.Handler) http.Handler {
 
 		// Parse token with claims
 		tokenData := &authstruct.TokenStruct{}
-		token, err := jwt.ParseWithClaims(tokenString, tokenData, func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
+		token, err := jwtkeys.Parse(tokenString, tokenData)
 
 		if err != nil {
 			if err == jwt.ErrSignatureInvalid {
@@ -51,6 +58,15 @@ func AuthHandler(next http.Handler) http.Handler {
 					IsGorm:  true,
 				})
 			}
+			// Access tokens are short lived, the client has to use /auth/refresh
+			if validationErr, ok := err.(*jwt.ValidationError); ok && validationErr.Errors&jwt.ValidationErrorExpired != 0 {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="token expired"`)
+				panic(GormError{
+					Code:    http.StatusUnauthorized,
+					Message: "Token expired",
+					IsGorm:  true,
+				})
+			}
 			panic(GormError{
 				Code:    http.StatusUnauthorized,
 				Message: "Invalid token",
@@ -85,6 +101,48 @@ func AuthHandler(next http.Handler) http.Handler {
 	})
 }
 
+// SessionOnlyHandler rejects the API keys, used on the routes that manage sessions and credentials
+func SessionOnlyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey).(*authstruct.TokenStruct)
+		if user.ApiKeyID != 0 {
+			panic(GormError{
+				Code:    http.StatusForbidden,
+				Message: "Not allowed with an API key",
+				IsGorm:  true,
+			})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateApiKey returns the claims of the owner of the key limited to the profiles of its scopes
+func validateApiKey(key string, r *http.Request) *authstruct.TokenStruct {
+	apiKey, err := apikeys.Validate(key, utils.ClientIP(r))
+	if err != nil {
+		if err == apikeys.ErrExpiredKey {
+			panic(GormError{
+				Code:    http.StatusUnauthorized,
+				Message: "API key expired",
+				IsGorm:  true,
+			})
+		}
+		panic(GormError{
+			Code:    http.StatusUnauthorized,
+			Message: "Invalid API key",
+			IsGorm:  true,
+		})
+	}
+
+	return &authstruct.TokenStruct{
+		Username: apiKey.OwnerName,
+		Email:    apiKey.OwnerEmail,
+		Id:       int(apiKey.UserID),
+		ApiKeyID: apiKey.ID,
+		Profiles: apiKey.Profiles(),
+	}
+}
+
 /*
 	Why this code is needed
 	This code has the same purpose as the previous one, but is not a middleware, it can be use in any part of the code.
@@ -92,12 +150,19 @@ func AuthHandler(next http.Handler) http.Handler {
 */
 
 func ValidateUser(authHeader string) int {
-	var jwtKey = []byte(os.Getenv("JWTSECRET"))
+	tokenData := ValidateUserClaims(authHeader)
+	if tokenData == nil {
+		return -1
+	}
+	return tokenData.Id
+}
 
+// ValidateUserClaims is ValidateUser returning the whole token, nil when it is not valid
+func ValidateUserClaims(authHeader string) *authstruct.TokenStruct {
 	// Get token from Authorization header
 	if authHeader == "" {
 		logger.Error("Authorization header missing")
-		return -1
+		return nil
 	}
 
 	// Remove Bearer prefix if present
@@ -107,41 +172,43 @@ func ValidateUser(authHeader string) int {
 	// Ensure token is not empty
 	if tokenString == "" {
 		logger.Error("Token is missing after Bearer")
-		return -1
+		return nil
 	}
 
 	// Validate JWT format
 	if !strings.Contains(tokenString, ".") {
 		logger.Error("Token is not in the correct JWT format")
-		return -1
+		return nil
 	}
 
 	// Parse token with claims
 	tokenData := &authstruct.TokenStruct{}
-	token, err := jwt.ParseWithClaims(tokenString, tokenData, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+	token, err := jwtkeys.Parse(tokenString, tokenData)
 
 	if err != nil {
 		if err == jwt.ErrSignatureInvalid {
 			logger.Error("Stop hacking!")
-			return -1
+			return nil
+		}
+		if validationErr, ok := err.(*jwt.ValidationError); ok && validationErr.Errors&jwt.ValidationErrorExpired != 0 {
+			logger.Info("Token expired")
+			return nil
 		}
 		logger.Error("Invalid token")
-		return -1
+		return nil
 	}
 
 	if !token.Valid {
 		logger.Error("Invalid token")
-		return -1
+		return nil
 	}
 
 	// Validate session in Redis
 	err = session.ValidateSession(tokenData.SessionID, tokenData.Id)
 	if err != nil {
 		logger.Error("Session expired or invalid")
-		return -1
+		return nil
 	}
 
-	return tokenData.Id
+	return tokenData
 }
@@ -25,7 +25,7 @@ func GormErrorHandler(next http.Handler) http.Handler {
 			if err := recover(); err != nil {
 				if r, ok := err.(GormError); ok { // It is a gorm error
 					var Message string = "Controled panic occurred from " + request.RemoteAddr + " to " + request.URL.Path
-					logger.Error(Message, zap.Any("error", err))
+					logger.Error(Message, zap.Any("error", err), zap.String("request_id", RequestID(request.Context())))
 					http.Error(w, r.Message, r.Code)
 				} else {
 					panic(err)
@@ -42,7 +42,7 @@ func ErrorHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				logger.Error("Panic occurred", zap.Any("error", err))
+				logger.Error("Panic occurred", zap.Any("error", err), zap.String("request_id", RequestID(r.Context())))
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 			}
 		}()
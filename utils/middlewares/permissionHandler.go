@@ -0,0 +1,28 @@
+package middlewares
+
+import (
+	"net/http"
+
+	authstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/struct"
+	"github.com/Gamequic/LivePreviewBackend/pkg/permissions"
+)
+
+// RequirePermission allows the request when a profile of the user has the permission,
+// it goes after AuthHandler
+func RequirePermission(permission string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := r.Context().Value(UserKey).(*authstruct.TokenStruct)
+
+			if !permissions.Has(user.Profiles, permission) {
+				panic(GormError{
+					Code:    http.StatusForbidden,
+					Message: "Access denied, missing permission " + permission,
+					IsGorm:  true,
+				})
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
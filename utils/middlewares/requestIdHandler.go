@@ -0,0 +1,59 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/Gamequic/LivePreviewBackend/utils"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+/*
+	Every request gets an ID. A proxy or a client can send its own on X-Request-ID, otherwise
+	one is made. It is answered on the same header, kept on the context and written on the log
+	of the request and of its errors as request_id, so the logs viewer finds all of them.
+*/
+
+const RequestIDHeader = "X-Request-ID"
+
+const RequestIDKey contextKey = "requestId"
+
+// Anything else sent by the client is replaced, it ends up on the logs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func RequestIDHandler(next http.Handler) http.Handler {
+	logger = utils.NewLogger()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), RequestIDKey, id))
+
+		// The wrapper keeps the WebSockets and the event streams working
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		if r.URL.Path == "/checkhealth" {
+			return
+		}
+		logger.Info("Request handled",
+			zap.String("request_id", id),
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", metrics.Code),
+			zap.Int64("duration_ms", metrics.Duration.Milliseconds()),
+			zap.String("ip", utils.ClientIP(r)),
+		)
+	})
+}
+
+// RequestID returns the ID of the request, empty outside of one
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(RequestIDKey).(string)
+	return id
+}
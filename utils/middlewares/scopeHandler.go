@@ -0,0 +1,14 @@
+package middlewares
+
+import (
+	"net/http"
+
+	authstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/struct"
+	"github.com/Gamequic/LivePreviewBackend/pkg/scope"
+)
+
+// UserScope returns the hospitals and doctors the user of the request can see, it goes after AuthHandler
+func UserScope(r *http.Request) scope.Scope {
+	user := r.Context().Value(UserKey).(*authstruct.TokenStruct)
+	return scope.ForUser(user.Id, user.Profiles)
+}
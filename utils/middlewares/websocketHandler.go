@@ -0,0 +1,106 @@
+package middlewares
+
+import (
+	"net/http"
+	"time"
+
+	authstruct "github.com/Gamequic/LivePreviewBackend/pkg/features/auth/struct"
+	"github.com/Gamequic/LivePreviewBackend/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+	Browsers can not set headers on a WebSocket, so the access token travels as a subprotocol:
+	new WebSocket(url, ["bearer", token]). The server answers with "bearer".
+	Clients that do not send it authenticate with the first message, as before.
+*/
+
+const WebSocketAuthProtocol = "bearer"
+
+// WebSocketProtocolToken returns the token offered after WebSocketAuthProtocol, empty when there is none
+func WebSocketProtocolToken(r *http.Request) string {
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if protocol == WebSocketAuthProtocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+	return ""
+}
+
+// UpgradeAuthenticated upgrades the connection once the user is known, with the token of the
+// subprotocol or with the first message sent before the timeout. Both are nil when it fails
+func UpgradeAuthenticated(w http.ResponseWriter, r *http.Request, timeout time.Duration) (*websocket.Conn, *authstruct.TokenStruct) {
+	var claims *authstruct.TokenStruct
+	var header http.Header
+
+	if token := WebSocketProtocolToken(r); token != "" {
+		// Rejected before the upgrade, the client gets a plain 401
+		claims = ValidateUserClaims(token)
+		if claims == nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return nil, nil
+		}
+		header = http.Header{"Sec-Websocket-Protocol": {WebSocketAuthProtocol}}
+	}
+
+	conn, err := utils.Upgrader.Upgrade(w, r, header)
+	if err != nil {
+		logger.Error("Could not upgrade to WebSocket: " + err.Error())
+		return nil, nil
+	}
+
+	if claims == nil {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		_, message, err := conn.ReadMessage()
+		if err == nil {
+			claims = ValidateUserClaims(string(message))
+		}
+		if claims == nil {
+			CloseWebSocket(conn, websocket.ClosePolicyViolation, "Authentication failed")
+			return nil, nil
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+
+	return conn, claims
+}
+
+// CloseWebSocket tells the client why the connection is closed and closes it
+func CloseWebSocket(conn *websocket.Conn, code int, reason string) {
+	message := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	conn.Close()
+}
+
+// Heartbeat of the sockets, a client that does not answer the pings is disconnected
+const (
+	WebSocketPingInterval = 25 * time.Second
+	WebSocketPongWait     = 60 * time.Second
+)
+
+// WatchWebSocket reads the socket for a client that only talks to close and to answer the
+// pings, reading is needed to notice both. The channel gets the reason once the client is gone
+func WatchWebSocket(conn *websocket.Conn) <-chan error {
+	conn.SetReadDeadline(time.Now().Add(WebSocketPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(WebSocketPongWait))
+	})
+
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+	return closed
+}
+
+// PingWebSocket sends the ping of the heartbeat, false when the client is gone
+func PingWebSocket(conn *websocket.Conn) bool {
+	return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)) == nil
+}
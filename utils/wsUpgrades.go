@@ -2,12 +2,31 @@ package utils
 
 import (
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/gorilla/websocket"
 )
 
+// Origins of the frontends, used by CORS and by the WebSocket upgrades
+var AllowedOrigins = []string{"http://localhost:8081"}
+
 var Upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // ⚠️ Permite conexiones desde cualquier origen (usar con precaución)
-	},
+	CheckOrigin: checkOrigin,
+}
+
+// checkOrigin accepts the allowed origins and the API itself. Clients that are not browsers
+// send no Origin and are authenticated by the socket as any other request
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	parsed, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(parsed.Host, r.Host)
 }